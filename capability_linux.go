@@ -0,0 +1,281 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Capability is a linux capability number, e.g.
+// Capability(unix.CAP_NET_BIND_SERVICE).
+type Capability uint
+
+var capabilityNames = map[Capability]string{
+	unix.CAP_CHOWN:              "CAP_CHOWN",
+	unix.CAP_DAC_OVERRIDE:       "CAP_DAC_OVERRIDE",
+	unix.CAP_DAC_READ_SEARCH:    "CAP_DAC_READ_SEARCH",
+	unix.CAP_FOWNER:             "CAP_FOWNER",
+	unix.CAP_FSETID:             "CAP_FSETID",
+	unix.CAP_KILL:               "CAP_KILL",
+	unix.CAP_SETGID:             "CAP_SETGID",
+	unix.CAP_SETUID:             "CAP_SETUID",
+	unix.CAP_SETPCAP:            "CAP_SETPCAP",
+	unix.CAP_LINUX_IMMUTABLE:    "CAP_LINUX_IMMUTABLE",
+	unix.CAP_NET_BIND_SERVICE:   "CAP_NET_BIND_SERVICE",
+	unix.CAP_NET_BROADCAST:      "CAP_NET_BROADCAST",
+	unix.CAP_NET_ADMIN:          "CAP_NET_ADMIN",
+	unix.CAP_NET_RAW:            "CAP_NET_RAW",
+	unix.CAP_IPC_LOCK:           "CAP_IPC_LOCK",
+	unix.CAP_IPC_OWNER:          "CAP_IPC_OWNER",
+	unix.CAP_SYS_MODULE:         "CAP_SYS_MODULE",
+	unix.CAP_SYS_RAWIO:          "CAP_SYS_RAWIO",
+	unix.CAP_SYS_CHROOT:         "CAP_SYS_CHROOT",
+	unix.CAP_SYS_PTRACE:         "CAP_SYS_PTRACE",
+	unix.CAP_SYS_PACCT:          "CAP_SYS_PACCT",
+	unix.CAP_SYS_ADMIN:          "CAP_SYS_ADMIN",
+	unix.CAP_SYS_BOOT:           "CAP_SYS_BOOT",
+	unix.CAP_SYS_NICE:           "CAP_SYS_NICE",
+	unix.CAP_SYS_RESOURCE:       "CAP_SYS_RESOURCE",
+	unix.CAP_SYS_TIME:           "CAP_SYS_TIME",
+	unix.CAP_SYS_TTY_CONFIG:     "CAP_SYS_TTY_CONFIG",
+	unix.CAP_MKNOD:              "CAP_MKNOD",
+	unix.CAP_LEASE:              "CAP_LEASE",
+	unix.CAP_AUDIT_WRITE:        "CAP_AUDIT_WRITE",
+	unix.CAP_AUDIT_CONTROL:      "CAP_AUDIT_CONTROL",
+	unix.CAP_SETFCAP:            "CAP_SETFCAP",
+	unix.CAP_MAC_OVERRIDE:       "CAP_MAC_OVERRIDE",
+	unix.CAP_MAC_ADMIN:          "CAP_MAC_ADMIN",
+	unix.CAP_SYSLOG:             "CAP_SYSLOG",
+	unix.CAP_WAKE_ALARM:         "CAP_WAKE_ALARM",
+	unix.CAP_BLOCK_SUSPEND:      "CAP_BLOCK_SUSPEND",
+	unix.CAP_AUDIT_READ:         "CAP_AUDIT_READ",
+	unix.CAP_PERFMON:            "CAP_PERFMON",
+	unix.CAP_BPF:                "CAP_BPF",
+	unix.CAP_CHECKPOINT_RESTORE: "CAP_CHECKPOINT_RESTORE",
+}
+
+func (c Capability) String() string {
+	if name, ok := capabilityNames[c]; ok {
+		return name
+	}
+	return "CAP_" + strconv.Itoa(int(c))
+}
+
+// ParseCapability parses a name like "CAP_NET_BIND_SERVICE" or
+// "net_bind_service".
+func ParseCapability(name string) (Capability, error) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "CAP_") {
+		name = "CAP_" + name
+	}
+	for c, n := range capabilityNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown capability %q", name)
+}
+
+// CapSet is a capability bit mask as found in /proc/<pid>/status.
+type CapSet uint64
+
+func NewCapSet(caps ...Capability) CapSet {
+	var s CapSet
+	for _, c := range caps {
+		s |= 1 << c
+	}
+	return s
+}
+
+func (s CapSet) Has(c Capability) bool {
+	return c < 64 && s&(1<<c) != 0
+}
+
+func (s CapSet) List() []Capability {
+	var caps []Capability
+	for c := Capability(0); c < 64; c++ {
+		if s.Has(c) {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
+
+func (s CapSet) String() string {
+	var names []string
+	for _, c := range s.List() {
+		names = append(names, c.String())
+	}
+	return strings.Join(names, ",")
+}
+
+// Capabilities holds the capability sets of a process.
+type Capabilities struct {
+	Inheritable CapSet
+	Permitted   CapSet
+	Effective   CapSet
+	Bounding    CapSet
+	Ambient     CapSet
+}
+
+// CanSetUser reports whether the process may switch uid and gid, the
+// requirement behind SetUser and SetSysCredential.
+func (c *Capabilities) CanSetUser() bool {
+	return c.Effective.Has(unix.CAP_SETUID) && c.Effective.Has(unix.CAP_SETGID)
+}
+
+// ReadCapabilities reads the capability sets of pid from /proc/<pid>/status.
+func ReadCapabilities(pid int) (*Capabilities, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	caps := &Capabilities{}
+	sets := map[string]*CapSet{
+		"CapInh": &caps.Inheritable,
+		"CapPrm": &caps.Permitted,
+		"CapEff": &caps.Effective,
+		"CapBnd": &caps.Bounding,
+		"CapAmb": &caps.Ambient,
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		set, found := sets[key]
+		if !ok || !found {
+			continue
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", key, err)
+		}
+		*set = CapSet(v)
+	}
+	return caps, scanner.Err()
+}
+
+// CurrentCapabilities reads the capability sets of the current process.
+func CurrentCapabilities() (*Capabilities, error) {
+	return ReadCapabilities(os.Getpid())
+}
+
+// CheckCapabilities returns an error naming the capabilities missing from
+// the effective set of the current process.
+func CheckCapabilities(caps ...Capability) error {
+	cur, err := CurrentCapabilities()
+	if err != nil {
+		return err
+	}
+	missing := NewCapSet(caps...) &^ cur.Effective
+	if missing != 0 {
+		return fmt.Errorf("missing capabilities %s", missing.String())
+	}
+	return nil
+}
+
+// KeepCapabilities limits the subprocess to caps: everything else is
+// dropped from its bounding set, and caps are kept across the uid/gid
+// switch of SetUser or SetSysCredential as ambient capabilities. Without
+// arguments all capabilities are dropped. Needs CAP_SETPCAP.
+func (c *Cmd) KeepCapabilities(caps ...Capability) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	keep := NewCapSet(caps...)
+	if c.capabilities != nil {
+		keep |= *c.capabilities
+	}
+	c.capabilities = &keep
+	return c
+}
+
+type capConfig struct {
+	Keep       CapSet              `json:"keep"`
+	Credential *syscall.Credential `json:"credential,omitempty"`
+}
+
+// capConfig takes the uid/gid switch over from exec, so the trampoline can
+// drop the bounding set as root first. The caller holds c.lock.
+func (c *Cmd) capConfig() *capConfig {
+	if c.capabilities == nil {
+		return nil
+	}
+	cfg := &capConfig{Keep: *c.capabilities}
+	if attr := c.cmd.SysProcAttr; attr != nil && attr.Credential != nil {
+		cfg.Credential = attr.Credential
+		copied := *attr
+		copied.Credential = nil
+		c.cmd.SysProcAttr = &copied
+	}
+	return cfg
+}
+
+// applyCapabilities runs in the trampoline. capset and the ambient set are
+// per thread, the init function keeps the thread locked until exec.
+func applyCapabilities(cfg *capConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	last := Capability(unix.CAP_LAST_CAP)
+	if v, err := strconv.Atoi(readSysctl("kernel/cap_last_cap")); err == nil {
+		last = Capability(v)
+	}
+	for c := Capability(0); c <= last; c++ {
+		if cfg.Keep.Has(c) {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0); err != nil && err != syscall.EINVAL {
+			return os.NewSyscallError("prctl(PR_CAPBSET_DROP "+c.String()+")", err)
+		}
+	}
+
+	if cred := cfg.Credential; cred != nil {
+		if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+			return os.NewSyscallError("prctl(PR_SET_KEEPCAPS)", err)
+		}
+		if !cred.NoSetGroups {
+			groups := make([]int, len(cred.Groups))
+			for i, g := range cred.Groups {
+				groups[i] = int(g)
+			}
+			if err := syscall.Setgroups(groups); err != nil {
+				return os.NewSyscallError("setgroups", err)
+			}
+		}
+		if err := syscall.Setgid(int(cred.Gid)); err != nil {
+			return os.NewSyscallError("setgid", err)
+		}
+		if err := syscall.Setuid(int(cred.Uid)); err != nil {
+			return os.NewSyscallError("setuid", err)
+		}
+	}
+
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return os.NewSyscallError("capget", err)
+	}
+	for i := range data {
+		keep := uint32(cfg.Keep >> (32 * i))
+		if missing := keep &^ data[i].Permitted; missing != 0 {
+			return &os.SyscallError{Syscall: "keep " + (CapSet(missing) << (32 * i)).String(), Err: syscall.EPERM}
+		}
+		data[i].Effective = keep
+		data[i].Permitted = keep
+		data[i].Inheritable = keep
+	}
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		return os.NewSyscallError("capset", err)
+	}
+	for _, c := range cfg.Keep.List() {
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(c), 0, 0); err != nil {
+			return os.NewSyscallError("prctl(PR_CAP_AMBIENT_RAISE "+c.String()+")", err)
+		}
+	}
+	return nil
+}
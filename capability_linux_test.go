@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReadCapabilities(t *testing.T) {
+	caps, err := CurrentCapabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.Effective&^caps.Permitted != 0 {
+		t.Fatalf("effective %s not within permitted %s", caps.Effective, caps.Permitted)
+	}
+	if c, err := ParseCapability("net_bind_service"); err != nil || c != unix.CAP_NET_BIND_SERVICE {
+		t.Fatalf("ParseCapability: %v %v", c, err)
+	}
+}
+
+func TestCmdKeepCapabilities(t *testing.T) {
+	if err := CheckCapabilities(unix.CAP_SETUID, unix.CAP_SETGID, unix.CAP_SETPCAP); err != nil {
+		t.Skip(err)
+	}
+	cmd := NewCmd().
+		SetSysCredential(syscall.Credential{Uid: 65534, Gid: 65534}).
+		KeepCapabilities(unix.CAP_NET_BIND_SERVICE)
+	defer cmd.Close()
+	out, err := cmd.RunCommand("/bin/sh", "-c", "id -u; grep ^Cap /proc/self/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 6 || lines[0] != "65534" {
+		t.Fatalf("unexpected output %q", out)
+	}
+	want := strconv.FormatUint(uint64(NewCapSet(unix.CAP_NET_BIND_SERVICE)), 16)
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		v, _ := strconv.ParseUint(fields[1], 16, 64)
+		if strconv.FormatUint(v, 16) != want {
+			t.Fatalf("%s %s, want %s", fields[0], fields[1], want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+)
+
+// CapturePolicy decides which part of the output is kept in memory once it
+// exceeds the capture limit.
+type CapturePolicy int
+
+const (
+	// CaptureHead keeps the first Size bytes.
+	CaptureHead CapturePolicy = iota
+	// CaptureTail keeps the last Size bytes.
+	CaptureTail
+	// CaptureHeadTail keeps the first and the last Size/2 bytes with a
+	// truncation marker in between.
+	CaptureHeadTail
+)
+
+// CaptureLimit bounds how much output of one stream is kept in memory. A
+// Size of zero keeps everything.
+type CaptureLimit struct {
+	Size   int
+	Policy CapturePolicy
+	// Spill writes the bytes that are not kept to a temp file in SpillDir,
+	// or the default temp dir, instead of dropping them. The caller removes
+	// the file.
+	Spill    bool
+	SpillDir string
+}
+
+// captureBuffer is the sink of an IOReadCloser. It keeps up to the head
+// size of the output in head and the latest output in the ring tail.
+type captureBuffer struct {
+	limit    CaptureLimit
+	head     []byte
+	tail     []byte
+	tailSize int
+	pos      int
+	n        int
+	dropped  int64
+	spill    *os.File
+	spillErr error
+	spilled  string
+}
+
+// sizes splits the limit into the bytes kept from the start and from the
+// end of the output. head is -1 without a limit.
+func (l CaptureLimit) sizes() (head, tail int) {
+	if l.Size <= 0 {
+		return -1, 0
+	}
+	switch l.Policy {
+	case CaptureTail:
+		return 0, l.Size
+	case CaptureHeadTail:
+		return l.Size / 2, l.Size - l.Size/2
+	default:
+		return l.Size, 0
+	}
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	headSize, tailSize := b.limit.sizes()
+	if headSize < 0 {
+		b.head = append(b.head, p...)
+		return n, nil
+	}
+	if room := headSize - len(b.head); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		b.head = append(b.head, p[:room]...)
+		p = p[room:]
+	}
+	if tailSize == 0 {
+		b.drop(p)
+		return n, nil
+	}
+	b.tailSize = tailSize
+	// the ring grows with the output until it is full
+	if room := tailSize - len(b.tail); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		b.tail = append(b.tail, p[:room]...)
+		b.n = len(b.tail)
+		p = p[room:]
+	}
+	if len(p) > 0 {
+		b.writeRing(p)
+	}
+	return n, nil
+}
+
+// writeRing writes p to the full ring and drops what it overwrites.
+func (b *captureBuffer) writeRing(p []byte) {
+	size := len(b.tail)
+	if len(p) >= size {
+		b.dropRing(b.n)
+		b.drop(p[:len(p)-size])
+		copy(b.tail, p[len(p)-size:])
+		b.pos = 0
+		b.n = size
+		return
+	}
+	if over := b.n + len(p) - size; over > 0 {
+		b.dropRing(over)
+	}
+	w := (b.pos + b.n) % size
+	k := copy(b.tail[w:], p)
+	copy(b.tail, p[k:])
+	b.n += len(p)
+}
+
+// dropRing drops the oldest count bytes of the ring.
+func (b *captureBuffer) dropRing(count int) {
+	size := len(b.tail)
+	end := b.pos + count
+	if end > size {
+		b.drop(b.tail[b.pos:])
+		b.drop(b.tail[:end-size])
+	} else {
+		b.drop(b.tail[b.pos:end])
+	}
+	b.pos = end % size
+	b.n -= count
+}
+
+// drop counts the bytes that are not kept and spills them if enabled.
+func (b *captureBuffer) drop(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	b.dropped += int64(len(p))
+	if !b.limit.Spill || b.spillErr != nil {
+		return
+	}
+	if b.spill == nil {
+		if b.spilled != "" {
+			// written to after the pipe was closed
+			b.spillErr = os.ErrClosed
+			return
+		}
+		b.spill, b.spillErr = os.CreateTemp(b.limit.SpillDir, "utils-output-*")
+		if b.spillErr != nil {
+			return
+		}
+		b.spilled = b.spill.Name()
+	}
+	_, b.spillErr = b.spill.Write(p)
+}
+
+func (b *captureBuffer) closeSpill() {
+	if b.spill != nil {
+		if err := b.spill.Close(); err != nil && b.spillErr == nil {
+			b.spillErr = err
+		}
+		b.spill = nil
+	}
+}
+
+// Bytes returns the kept output. It is a copy when the policy keeps a
+// tail.
+func (b *captureBuffer) Bytes() []byte {
+	if b.tailSize == 0 {
+		return b.head
+	}
+	out := make([]byte, 0, len(b.head)+b.n+64)
+	out = append(out, b.head...)
+	if b.dropped > 0 && b.limit.Policy == CaptureHeadTail {
+		out = append(out, fmt.Sprintf("\n[... %d bytes truncated ...]\n", b.dropped)...)
+	}
+	end := b.pos + b.n
+	if end > len(b.tail) {
+		out = append(out, b.tail[b.pos:]...)
+		return append(out, b.tail[:end-len(b.tail)]...)
+	}
+	return append(out, b.tail[b.pos:end]...)
+}
+
+// SetCaptureLimit bounds how much of stream, STDOUT or STDERR, is kept for
+// GetOutput and the Result. Result reports how many bytes were dropped.
+func (c *Cmd) SetCaptureLimit(stream int, limit CaptureLimit) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch stream {
+	case STDOUT:
+		c.stdoutLimit = limit
+	case STDERR:
+		c.stderrLimit = limit
+	}
+	return c
+}
+
+// startCapture applies the capture limits to the output readers before they
+// are started. The caller holds c.lock.
+func (c *Cmd) startCapture() {
+	c.stdoutbuf.SetLimit(c.stdoutLimit)
+	c.stderrbuf.SetLimit(c.stderrLimit)
+}
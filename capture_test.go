@@ -0,0 +1,87 @@
+package utils_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"testing/iotest"
+
+	"github.com/realjf/utils"
+)
+
+func readAll(t *testing.T, r *utils.IOReadCloser) {
+	for {
+		_, err := r.ReadChunk()
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIOReadCloserLimit(t *testing.T) {
+	data := make([]byte, 100*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	size := 10 * 1024
+	dropped := int64(len(data) - size)
+	marker := fmt.Sprintf("\n[... %d bytes truncated ...]\n", dropped)
+	tests := []struct {
+		policy utils.CapturePolicy
+		want   []byte
+		spill  []byte
+	}{
+		{utils.CaptureHead, data[:size], data[size:]},
+		{utils.CaptureTail, data[len(data)-size:], data[:len(data)-size]},
+		{
+			utils.CaptureHeadTail,
+			append(append(append([]byte(nil), data[:size/2]...), marker...), data[len(data)-size/2:]...),
+			data[size/2 : len(data)-size/2],
+		},
+	}
+	readers := map[string]func() io.Reader{
+		"chunks":   func() io.Reader { return bytes.NewReader(data) },
+		"one byte": func() io.Reader { return iotest.OneByteReader(bytes.NewReader(data)) },
+	}
+	for _, tt := range tests {
+		for name, reader := range readers {
+			r := utils.NewReader(io.NopCloser(reader()))
+			r.SetLimit(utils.CaptureLimit{Size: size, Policy: tt.policy, Spill: true, SpillDir: t.TempDir()})
+			readAll(t, r)
+			if !bytes.Equal(r.Bytes(), tt.want) {
+				t.Fatalf("policy %d, %s: unexpected output", tt.policy, name)
+			}
+			if r.Dropped() != dropped {
+				t.Fatalf("policy %d, %s: dropped %d bytes", tt.policy, name, r.Dropped())
+			}
+			path, err := r.SpillFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			spilled, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(spilled, tt.spill) {
+				t.Fatalf("policy %d, %s: unexpected spill file", tt.policy, name)
+			}
+		}
+	}
+
+	// below the limit nothing is dropped
+	r := utils.NewReader(io.NopCloser(bytes.NewReader(data[:100])))
+	r.SetLimit(utils.CaptureLimit{Size: size, Policy: utils.CaptureHeadTail})
+	readAll(t, r)
+	if !bytes.Equal(r.Bytes(), data[:100]) || r.Dropped() != 0 {
+		t.Fatalf("unexpected output below the limit, dropped %d", r.Dropped())
+	}
+	if path, _ := r.SpillFile(); path != "" {
+		t.Fatalf("unexpected spill file %s", path)
+	}
+}
@@ -0,0 +1,331 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	DefaultCgroupRoot   = "/sys/fs/cgroup"
+	defaultCPUPeriod    = 100 * time.Millisecond
+	cgroupRemoveTimeout = 5 * time.Second
+)
+
+var cgroupSeq uint64
+
+// CgroupConfig places a command in its own cgroup v2 leaf below
+// Root/Parent, before it runs. Zero values leave the corresponding limit
+// unset. Root may point at a plain directory standing in for cgroupfs, e.g.
+// in tests.
+type CgroupConfig struct {
+	Root      string
+	Parent    string
+	Name      string
+	MemoryMax int64
+	CPUQuota  time.Duration
+	CPUPeriod time.Duration
+	PidsMax   int64
+	IOMax     []string
+}
+
+func (c *Cmd) SetCgroup(cfg CgroupConfig) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cgroup = &cfg
+	return c
+}
+
+// GetCgroupPath returns the cgroup directory of the running command, or ""
+// once it has been torn down.
+func (c *Cmd) GetCgroupPath() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cgroupPath
+}
+
+func (cfg *CgroupConfig) controllers() []string {
+	ctrls := []string{"memory"}
+	if cfg.CPUQuota > 0 {
+		ctrls = append(ctrls, "cpu")
+	}
+	if cfg.PidsMax > 0 {
+		ctrls = append(ctrls, "pids")
+	}
+	if len(cfg.IOMax) > 0 {
+		ctrls = append(ctrls, "io")
+	}
+	return ctrls
+}
+
+func (cfg *CgroupConfig) settings() [][2]string {
+	var files [][2]string
+	if cfg.MemoryMax > 0 {
+		files = append(files, [2]string{"memory.max", strconv.FormatInt(cfg.MemoryMax, 10)})
+	}
+	if cfg.CPUQuota > 0 {
+		period := cfg.CPUPeriod
+		if period <= 0 {
+			period = defaultCPUPeriod
+		}
+		files = append(files, [2]string{"cpu.max", fmt.Sprintf("%d %d", cfg.CPUQuota.Microseconds(), period.Microseconds())})
+	}
+	if cfg.PidsMax > 0 {
+		files = append(files, [2]string{"pids.max", strconv.FormatInt(cfg.PidsMax, 10)})
+	}
+	for _, line := range cfg.IOMax {
+		files = append(files, [2]string{"io.max", line})
+	}
+	return files
+}
+
+// createCgroup creates the leaf cgroup and writes the limits.
+// The caller holds c.lock.
+func (c *Cmd) createCgroup() error {
+	if c.cgroup == nil {
+		return nil
+	}
+	cfg := *c.cgroup
+	if cfg.Root == "" {
+		cfg.Root = DefaultCgroupRoot
+	}
+	if cfg.Name == "" {
+		cfg.Name = fmt.Sprintf("utils-%d-%d", os.Getpid(), atomic.AddUint64(&cgroupSeq, 1))
+	}
+	parent := filepath.Join(cfg.Root, cfg.Parent)
+	if err := enableControllers(parent, cfg.controllers()); err != nil {
+		return err
+	}
+
+	path := filepath.Join(parent, cfg.Name)
+	if err := os.Mkdir(path, 0755); err != nil {
+		return err
+	}
+	c.cgroupPath = path
+	for _, f := range cfg.settings() {
+		if err := writeCgroupFile(path, f[0], f[1]); err != nil {
+			c.removeCgroup()
+			return err
+		}
+	}
+	if c.debug {
+		log.Infof("created cgroup %s", path)
+	}
+	return nil
+}
+
+// openCgroupFD opens the leaf cgroup for clone3 with CLONE_INTO_CGROUP,
+// which places the child in it before it runs. It returns nil before linux
+// 5.7 and for a Root that is no cgroup2 mount, the child is held in the init
+// trampoline while joinCgroup moves it then. The caller holds c.lock.
+func (c *Cmd) openCgroupFD() (*os.File, error) {
+	if c.cgroupPath == "" || !kernelAtLeast(5, 7) {
+		return nil, nil
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(c.cgroupPath, &st); err != nil || st.Type != unix.CGROUP2_SUPER_MAGIC {
+		return nil, nil
+	}
+	return os.OpenFile(c.cgroupPath, os.O_RDONLY|unix.O_DIRECTORY, 0)
+}
+
+// kernelAtLeast compares the release of the running kernel with
+// major.minor.
+func kernelAtLeast(major, minor int) bool {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return false
+	}
+	var maj, min int
+	fmt.Sscanf(unix.ByteSliceToString(uts.Release[:]), "%d.%d", &maj, &min)
+	return maj > major || maj == major && min >= minor
+}
+
+// joinCgroup moves pid into the leaf cgroup. The caller holds c.lock.
+func (c *Cmd) joinCgroup(pid int) error {
+	if c.cgroupPath == "" {
+		return nil
+	}
+	return writeCgroupFile(c.cgroupPath, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// removeCgroup kills whatever is left in the leaf cgroup and removes it.
+// The caller holds c.lock.
+func (c *Cmd) removeCgroup() {
+	if c.cgroupPath == "" {
+		return
+	}
+	path := c.cgroupPath
+	c.cgroupPath = ""
+	if err := removeCgroupDir(path); err != nil {
+		if c.debug {
+			log.Error(err)
+		}
+	}
+}
+
+// finishCgroup reads the accounting into res and tears the cgroup down.
+func (c *Cmd) finishCgroup(res *Result) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.cgroupPath == "" {
+		return
+	}
+	stats, err := ReadCgroupStats(c.cgroupPath)
+	if err != nil {
+		if c.debug {
+			log.Error(err)
+		}
+	} else {
+		res.Cgroup = stats
+		if res.Limit == "" && stats.OOMKills > 0 && res.Signaled && res.Signal == syscall.SIGKILL {
+			res.Limit = "memory.max"
+		}
+	}
+	c.removeCgroup()
+}
+
+// ReadCgroupStats reads memory.peak, cpu.stat and memory.events of the
+// cgroup at path. Missing files are left at zero.
+func ReadCgroupStats(path string) (*CgroupStats, error) {
+	stats := &CgroupStats{Path: path}
+	data, err := os.ReadFile(filepath.Join(path, "memory.peak"))
+	if err == nil {
+		stats.MemoryPeak, _ = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	cpu, err := readCgroupKeyed(path, "cpu.stat")
+	if err != nil {
+		return nil, err
+	}
+	stats.CPUUsage = time.Duration(cpu["usage_usec"]) * time.Microsecond
+	stats.CPUUser = time.Duration(cpu["user_usec"]) * time.Microsecond
+	stats.CPUSystem = time.Duration(cpu["system_usec"]) * time.Microsecond
+	stats.NrThrottled = cpu["nr_throttled"]
+	stats.Throttled = time.Duration(cpu["throttled_usec"]) * time.Microsecond
+
+	events, err := readCgroupKeyed(path, "memory.events")
+	if err != nil {
+		return nil, err
+	}
+	stats.OOM = events["oom"]
+	stats.OOMKills = events["oom_kill"]
+	return stats, nil
+}
+
+func readCgroupKeyed(path, name string) (map[string]uint64, error) {
+	values := make(map[string]uint64)
+	f, err := os.Open(filepath.Join(path, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return values, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = v
+		}
+	}
+	return values, scanner.Err()
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(value)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write %s %q: %w", filepath.Join(dir, name), value, err)
+	}
+	return nil
+}
+
+// enableControllers enables ctrls for the children of parent, skipping the
+// ones the parent does not offer in cgroup.controllers.
+func enableControllers(parent string, ctrls []string) error {
+	data, err := os.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	available := strings.Fields(string(data))
+	var enable []string
+	for _, ctrl := range ctrls {
+		if ctrl == "memory" && err == nil && !containsString(available, ctrl) {
+			// only needed for accounting
+			continue
+		}
+		enable = append(enable, "+"+ctrl)
+	}
+	if len(enable) == 0 {
+		return nil
+	}
+	return writeCgroupFile(parent, "cgroup.subtree_control", strings.Join(enable, " "))
+}
+
+func removeCgroupDir(path string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return err
+	}
+	if st.Type != unix.CGROUP2_SUPER_MAGIC {
+		// a plain directory standing in for cgroupfs
+		return os.RemoveAll(path)
+	}
+
+	// cgroup.kill needs linux 5.14, older kernels fall back to the pids
+	if err := writeCgroupFile(path, "cgroup.kill", "1"); err != nil {
+		killCgroupProcs(path)
+	}
+	deadline := time.Now().Add(cgroupRemoveTimeout)
+	for {
+		err := syscall.Rmdir(path)
+		if err == nil || !errors.Is(err, syscall.EBUSY) || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func killCgroupProcs(path string) {
+	data, err := os.ReadFile(filepath.Join(path, "cgroup.procs"))
+	if err != nil {
+		return
+	}
+	for _, field := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCmdCgroupFakeRoot(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "jobs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cmd := NewCmd().SetCgroup(CgroupConfig{
+		Root:      root,
+		Parent:    "jobs",
+		MemoryMax: 64 << 20,
+		CPUQuota:  50 * time.Millisecond,
+		PidsMax:   16,
+		IOMax:     []string{"8:0 rbps=1048576"},
+	})
+	defer cmd.Close()
+	pid, err := cmd.Command("/bin/true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no cgroup2 to clone into, it joins while held in the trampoline
+	self, _ := os.Executable()
+	if exe, _ := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe"); exe != self {
+		t.Fatalf("joined the cgroup while running %s", exe)
+	}
+	path := cmd.GetCgroupPath()
+	for name, want := range map[string]string{
+		"memory.max":                "67108864",
+		"cpu.max":                   "50000 100000",
+		"pids.max":                  "16",
+		"io.max":                    "8:0 rbps=1048576",
+		"cgroup.procs":              strconv.Itoa(pid),
+		"../cgroup.subtree_control": "+memory +cpu +pids +io",
+	} {
+		data, err := os.ReadFile(filepath.Join(path, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Fatalf("%s: got %q, want %q", name, data, want)
+		}
+	}
+
+	// stand in for the accounting the kernel would provide
+	os.WriteFile(filepath.Join(path, "memory.peak"), []byte("1234\n"), 0644)
+	os.WriteFile(filepath.Join(path, "cpu.stat"), []byte("usage_usec 1500\nuser_usec 1000\nsystem_usec 500\nnr_throttled 2\n"), 0644)
+	os.WriteFile(filepath.Join(path, "memory.events"), []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 0\n"), 0644)
+
+	res, err := cmd.RunResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := res.Cgroup
+	if stats == nil || stats.MemoryPeak != 1234 || stats.CPUUsage != 1500*time.Microsecond ||
+		stats.CPUSystem != 500*time.Microsecond || stats.NrThrottled != 2 || stats.OOM != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("cgroup %s was not removed", path)
+	}
+}
+
+func TestCmdCgroupClone(t *testing.T) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(DefaultCgroupRoot, &st); err != nil || st.Type != unix.CGROUP2_SUPER_MAGIC {
+		t.Skip("cgroup v2 is not mounted at " + DefaultCgroupRoot)
+	}
+	if os.Getuid() != 0 {
+		t.Skip("needs root")
+	}
+	cmd := NewCmd().SetCgroup(CgroupConfig{})
+	defer cmd.Close()
+	pid, err := cmd.Command("/bin/true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cloned into it, the command is held at exec as without a cgroup
+	self, _ := os.Executable()
+	if exe, _ := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe"); exe == self {
+		t.Fatal("held in the trampoline")
+	}
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/cgroup")
+	want := "0::/" + strings.TrimPrefix(cmd.GetCgroupPath(), DefaultCgroupRoot+"/") + "\n"
+	if err != nil || !strings.HasSuffix(string(data), want) {
+		t.Fatalf("not in %s: %q %v", want, data, err)
+	}
+	if _, err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCmdCgroupMemoryMax(t *testing.T) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(DefaultCgroupRoot, &st); err != nil || st.Type != unix.CGROUP2_SUPER_MAGIC {
+		t.Skip("cgroup v2 is not mounted at " + DefaultCgroupRoot)
+	}
+	if os.Getuid() != 0 {
+		t.Skip("needs root")
+	}
+	data, _ := os.ReadFile(filepath.Join(DefaultCgroupRoot, "cgroup.controllers"))
+	if !strings.Contains(string(data), "memory") {
+		t.Skip("memory controller is not available")
+	}
+	parent, err := os.MkdirTemp(DefaultCgroupRoot, "utils-test-")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer os.Remove(parent)
+
+	cmd := NewCmd().SetCgroup(CgroupConfig{Parent: filepath.Base(parent), MemoryMax: 32 << 20})
+	defer cmd.Close()
+	res, err := cmd.RunCommandResult("/bin/sh", "-c", "x=$(head -c 268435456 /dev/zero | tr '\\0' a); echo ${#x}")
+	if err == nil || res.Cgroup == nil || res.Cgroup.OOMKills == 0 {
+		t.Fatalf("expected an oom kill, got %v, %+v", err, res.Cgroup)
+	}
+	// the shell itself holds the memory, it is the one killed
+	var limitErr *LimitError
+	if res.Signaled && (!errors.As(err, &limitErr) || limitErr.Resource != "memory.max") {
+		t.Fatalf("expected memory.max LimitError, got %#v", err)
+	}
+}
@@ -0,0 +1,375 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Settings that have to be applied in the child between fork and exec are
+// handled by re-executing the current binary (/proc/self/exe) with
+// childInitEnv set. The init function below picks the configuration up,
+// applies the settings, reports childReady on childStatusFd and blocks on
+// childSyncFd until the parent releases it. Then it execs the real command
+// in place, so the pid stays the same. Failures are reported back on
+// childStatusFd, which is closed on exec, so the parent reads EOF once the
+// command is running. Commands without such settings are started traced
+// and held at exec instead, see traceHold.
+const (
+	childInitEnv  = "_UTILS_CHILD_INIT"
+	childStatusFd = 3
+	childSyncFd   = 4
+	childReady    = "ready"
+)
+
+type childConfig struct {
+	Path     string              `json:"path"`
+	Rlimits  []Rlimit            `json:"rlimits,omitempty"`
+	Hostname string              `json:"hostname,omitempty"`
+	Caps     *capConfig          `json:"caps,omitempty"`
+	Landlock *landlockConfig     `json:"landlock,omitempty"`
+	Seccomp  [][]unix.SockFilter `json:"seccomp,omitempty"`
+	// Cgroup is joined by the parent while the child is held
+	Cgroup string `json:"-"`
+}
+
+func (cfg *childConfig) empty() bool {
+	return len(cfg.Rlimits) == 0 && cfg.Hostname == "" && cfg.Caps == nil && cfg.Landlock == nil && len(cfg.Seccomp) == 0 && cfg.Cgroup == ""
+}
+
+// childInitPipe is the parent side of the trampoline pipes.
+type childInitPipe struct {
+	status *os.File
+	dec    *json.Decoder
+	sync   *os.File
+	child  []*os.File
+}
+
+// started closes the child ends once the command was started.
+func (p *childInitPipe) started() {
+	if p == nil {
+		return
+	}
+	for _, f := range p.child {
+		f.Close()
+	}
+	p.child = nil
+}
+
+// release lets a child blocked on childSyncFd continue to exec.
+func (p *childInitPipe) release() error {
+	if p == nil || p.sync == nil {
+		return nil
+	}
+	_, err := p.sync.Write([]byte{0})
+	p.sync.Close()
+	p.sync = nil
+	return err
+}
+
+// close also makes a child that is still blocked on childSyncFd exit.
+func (p *childInitPipe) close() {
+	if p == nil {
+		return
+	}
+	p.started()
+	if p.sync != nil {
+		p.sync.Close()
+	}
+	p.status.Close()
+}
+
+// readStatus reads the next report of the child. It returns ready when the
+// child blocks before exec, and neither ready nor an error once the child
+// has exec'd the command or exited.
+func (p *childInitPipe) readStatus() (ready bool, err error) {
+	var status childStatus
+	if err = p.dec.Decode(&status); err != nil {
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	if status.Op == childReady {
+		return true, nil
+	}
+	return false, status.err()
+}
+
+type childStatus struct {
+	Op    string `json:"op"`
+	Errno int    `json:"errno"`
+	Msg   string `json:"msg"`
+}
+
+func (s *childStatus) err() error {
+	if s.Errno != 0 {
+		return &os.SyscallError{Syscall: s.Op, Err: syscall.Errno(s.Errno)}
+	}
+	return errors.New(s.Msg)
+}
+
+// init runs the trampoline when the program was re-executed by Command to
+// apply rlimits, capabilities, seccomp, Landlock or the hostname before
+// exec. The init functions of the packages imported by this one run in the
+// trampoline too, so they should not write any output.
+func init() {
+	data, ok := os.LookupEnv(childInitEnv)
+	if !ok {
+		return
+	}
+	runtime.LockOSThread()
+	err := childInit(data)
+
+	// only reached when the command could not be executed
+	status := childStatus{Op: "init", Msg: err.Error()}
+	var serr *os.SyscallError
+	if errors.As(err, &serr) {
+		status.Op = serr.Syscall
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		status.Errno = int(errno)
+	}
+	json.NewEncoder(os.NewFile(childStatusFd, "status")).Encode(&status)
+	os.Exit(127)
+}
+
+func childInit(data string) error {
+	var cfg childConfig
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		return err
+	}
+	env := make([]string, 0, len(os.Environ()))
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, childInitEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+
+	if cfg.Hostname != "" {
+		if err := unix.Sethostname([]byte(cfg.Hostname)); err != nil {
+			return os.NewSyscallError("sethostname", err)
+		}
+	}
+
+	for _, l := range cfg.Rlimits {
+		if err := syscall.Setrlimit(l.Resource, &syscall.Rlimit{Cur: l.Soft, Max: l.Hard}); err != nil {
+			return os.NewSyscallError("setrlimit "+rlimitName(l.Resource), err)
+		}
+	}
+
+	if err := applyCapabilities(cfg.Caps); err != nil {
+		return err
+	}
+
+	ready := childStatus{Op: childReady}
+	if err := json.NewEncoder(os.NewFile(childStatusFd, "status")).Encode(&ready); err != nil {
+		return err
+	}
+	sync := os.NewFile(childSyncFd, "sync")
+	n, err := sync.Read(make([]byte, 1))
+	if n != 1 {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return os.NewSyscallError("sync", err)
+	}
+	sync.Close()
+
+	syscall.CloseOnExec(childStatusFd)
+	if err := applyLandlock(cfg.Landlock); err != nil {
+		return err
+	}
+	// last, so the filters do not apply to the trampoline itself
+	if err := installSeccomp(cfg.Seccomp); err != nil {
+		return err
+	}
+	return os.NewSyscallError("exec "+cfg.Path, syscall.Exec(cfg.Path, os.Args, env))
+}
+
+// setupChildInit routes the command through the init trampoline when it
+// has settings to apply before exec, a cgroup to join that it cannot be
+// cloned into, or cannot be held traced, and returns nil otherwise. The
+// returned pipe has to be passed to waitChildReady once the command was
+// started.
+func (c *Cmd) setupChildInit(cgroupFD *os.File) (*childInitPipe, error) {
+	seccomp, err := c.compileSeccomp()
+	if err != nil {
+		return nil, err
+	}
+	landlock, err := c.landlockConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg := childConfig{
+		Path:     c.cmd.Path,
+		Rlimits:  c.rlimits,
+		Hostname: c.hostname,
+		Seccomp:  seccomp,
+		Landlock: landlock,
+		Caps:     c.capConfig(),
+	}
+	if cgroupFD == nil {
+		cfg.Cgroup = c.cgroupPath
+	}
+	path := c.cmd.Path
+	if strings.Contains(path, "/") && !filepath.IsAbs(path) && c.cmd.Dir != "" {
+		path = filepath.Join(c.cmd.Dir, path)
+	}
+	// a caller that traces the command itself cannot have it held traced
+	traced := c.cmd.SysProcAttr != nil && c.cmd.SysProcAttr.Ptrace
+	if cfg.empty() && !traced && traceable(path) {
+		return nil, nil
+	}
+	// report the errors exec.Cmd.Start would have reported
+	if _, err := exec.LookPath(path); err != nil {
+		return nil, err
+	}
+	if attr := c.cmd.SysProcAttr; attr != nil {
+		if err := checkInitExecutable(attr.Credential); err != nil {
+			return nil, err
+		}
+	}
+	data, err := json.Marshal(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	p := &childInitPipe{}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.status = r
+	p.dec = json.NewDecoder(r)
+	p.child = append(p.child, w)
+	r, w, err = os.Pipe()
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	p.sync = w
+	p.child = append(p.child, r)
+	c.cmd.Path = "/proc/self/exe"
+	c.cmd.Env = append(c.cmd.Env[:len(c.cmd.Env):len(c.cmd.Env)], childInitEnv+"="+string(data))
+	c.cmd.ExtraFiles = p.child
+	return p, nil
+}
+
+// checkInitExecutable checks that the program, which the trampoline
+// re-executes, can be executed with cred.
+func checkInitExecutable(cred *syscall.Credential) error {
+	if cred == nil || cred.Uid == 0 {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return checkExecutable(exe, cred)
+}
+
+// checkExecutable checks the mode bits of path and of the directories
+// above it. An exec still refused, e.g. by an ACL, is reported by
+// initStartError.
+func checkExecutable(path string, cred *syscall.Credential) error {
+	for dir := path; ; dir = filepath.Dir(dir) {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !mayExecute(fi, cred) {
+			return fmt.Errorf("%s as uid %d: %w", path, cred.Uid, ErrInitNotExecutable)
+		}
+		if dir == "/" {
+			return nil
+		}
+	}
+}
+
+func mayExecute(fi os.FileInfo, cred *syscall.Credential) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+	perm := fi.Mode().Perm()
+	if st.Uid == cred.Uid {
+		return perm&0o100 != 0
+	}
+	if st.Gid == cred.Gid {
+		return perm&0o010 != 0
+	}
+	for _, gid := range cred.Groups {
+		if st.Gid == gid {
+			return perm&0o010 != 0
+		}
+	}
+	return perm&0o001 != 0
+}
+
+// initStartError explains a trampoline that could not be executed, which
+// is no matter of the privileges of the parent.
+func initStartError(p *childInitPipe, err error) error {
+	if p == nil || !errors.Is(err, syscall.EACCES) {
+		return err
+	}
+	exe, _ := os.Executable()
+	return fmt.Errorf("%s: %w", exe, ErrInitNotExecutable)
+}
+
+// waitChildReady waits until the trampoline blocks before exec and returns
+// the error it reported otherwise, after reaping it. p is nil for a command
+// started directly.
+func (c *Cmd) waitChildReady(p *childInitPipe) error {
+	if p == nil {
+		return nil
+	}
+	p.started()
+	ready, err := p.readStatus()
+	if err == nil && !ready {
+		err = errors.New("init exited before exec")
+	}
+	if err != nil {
+		p.close()
+		c.cmd.Wait()
+		return err
+	}
+	return nil
+}
+
+// releaseChild lets the subprocess held by Command exec the command and
+// waits until it did. It returns the error the trampoline reported
+// otherwise, the subprocess has exited then.
+func (c *Cmd) releaseChild() error {
+	c.lock.Lock()
+	p := c.initPipe
+	trace := c.trace
+	c.initPipe = nil
+	c.trace = nil
+	if p != nil || trace != nil {
+		c.releaseCombined()
+	}
+	c.lock.Unlock()
+	if trace != nil {
+		return trace.release()
+	}
+	if p == nil {
+		return nil
+	}
+	defer p.close()
+	// a child killed while it was held is reaped as usual
+	if err := p.release(); err != nil && !errors.Is(err, syscall.EPIPE) {
+		return err
+	}
+	_, err := p.readStatus()
+	return err
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func openFds(t *testing.T) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestCmdChildInit(t *testing.T) {
+	self, _ := os.Executable()
+	cmd := NewCmd()
+	defer cmd.Close()
+	pid, err := cmd.Command("sleep", "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exe, _ := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe"); exe == self {
+		t.Fatal("started through the trampoline without settings applied before exec")
+	}
+	if fields, err := readStatFields(pid); err != nil || ProcessState(fields[0][0]) != ProcessTracingStop {
+		t.Fatalf("not held at exec: %v %v", fields, err)
+	}
+
+	cmd2 := NewCmd().SetRlimit(syscall.RLIMIT_NOFILE, 64, 64)
+	defer cmd2.Close()
+	if pid, err = cmd2.Command("sleep", "5"); err != nil {
+		t.Fatal(err)
+	}
+	if exe, _ := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe"); exe != self {
+		t.Fatalf("rlimits applied without the trampoline, held subprocess runs %s", exe)
+	}
+
+	// a traced exec would drop the privileges of a set-user-ID program
+	prog := t.TempDir() + "/true"
+	data, err := os.ReadFile("/bin/true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(prog, data, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(prog, 0o755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	cmd3 := NewCmd()
+	defer cmd3.Close()
+	if pid, err = cmd3.Command(prog); err != nil {
+		t.Fatal(err)
+	}
+	if exe, _ := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe"); (exe == self) != (os.Geteuid() != 0) {
+		t.Fatalf("set-user-ID program held in %s", exe)
+	}
+
+	// failing before Start leaks no pipes
+	before := openFds(t)
+	for i := 0; i < 20; i++ {
+		NewCmd().Command("/nonexistent/cmd")
+		NewCmd().SetRlimit(syscall.RLIMIT_NOFILE, 64, 64).Command("/nonexistent/cmd")
+	}
+	if after := openFds(t); after > before {
+		t.Fatalf("%d fds open before, %d after", before, after)
+	}
+}
+
+func TestCmdChildInitCredential(t *testing.T) {
+	// t.TempDir is below a directory only its owner can search
+	dir, err := os.MkdirTemp("", "utils-init-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	exe := dir + "/exe"
+	if err := os.WriteFile(exe, nil, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	nobody := &syscall.Credential{Uid: 65534, Gid: 65534}
+	if os.Geteuid() == 65534 {
+		// not the owner of the directory
+		nobody.Uid = 65533
+	}
+	if err := checkExecutable(exe, nobody); !errors.Is(err, ErrInitNotExecutable) {
+		t.Fatalf("expected ErrInitNotExecutable, got %v", err)
+	}
+	if err := os.Chmod(dir, 0o711); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkExecutable(exe, nobody); err != nil {
+		t.Fatal(err)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("switching the user needs root")
+	}
+	// without settings applied before exec the program is not executed
+	cmd := NewCmd().SetSysCredential(*nobody).SetWorkDir("/")
+	defer cmd.Close()
+	out, err := cmd.RunCommand("/bin/echo", "hello")
+	if err != nil || string(out) != "hello\n" {
+		t.Fatalf("unexpected output %q %v", out, err)
+	}
+
+	cmd2 := NewCmd().SetSysCredential(*nobody).SetWorkDir("/").SetRlimit(syscall.RLIMIT_NOFILE, 64, 64)
+	defer cmd2.Close()
+	out, err = cmd2.RunCommand("/bin/echo", "hello")
+	self, _ := os.Executable()
+	if checkExecutable(self, nobody) == nil {
+		if err != nil || string(out) != "hello\n" {
+			t.Fatalf("unexpected output %q %v", out, err)
+		}
+		return
+	}
+	var permErr *PermissionError
+	if !errors.Is(err, ErrInitNotExecutable) || errors.As(err, &permErr) {
+		t.Fatalf("expected ErrInitNotExecutable, got %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// OutputChunk is a piece of output as it was read from the subprocess.
+type OutputChunk struct {
+	// Stream is STDOUT or STDERR.
+	Stream int
+	Time   time.Time
+	// Offset is the time since the command was started, or released when
+	// it was held by Command, taken from the monotonic clock.
+	Offset time.Duration
+	Data   []byte
+}
+
+// combinedOutput records the chunks of stdout and stderr in the order they
+// were read. Chunks read at about the same time from the two pipes may be
+// recorded in either order. The chunks of each stream are bounded by its
+// capture limit, chunks emptied by it are skipped and compacted later.
+type combinedOutput struct {
+	lock   sync.Mutex
+	start  time.Time
+	chunks []OutputChunk
+	tail   []bool
+	empty  int
+	// indexed by STDOUT and STDERR
+	limits    [3]CaptureLimit
+	headBytes [3]int
+	tailBytes [3]int
+	oldest    [3]int
+}
+
+func (o *combinedOutput) observer(stream int) func([]byte) {
+	return func(data []byte) {
+		now := time.Now()
+		o.lock.Lock()
+		defer o.lock.Unlock()
+		headSize, tailSize := o.limits[stream].sizes()
+		if headSize < 0 {
+			o.add(stream, now, data, false)
+			return
+		}
+		if room := headSize - o.headBytes[stream]; room > 0 {
+			if room > len(data) {
+				room = len(data)
+			}
+			o.add(stream, now, data[:room], false)
+			o.headBytes[stream] += room
+			data = data[room:]
+		}
+		if tailSize == 0 || len(data) == 0 {
+			return
+		}
+		if len(data) > tailSize {
+			data = data[len(data)-tailSize:]
+		}
+		o.add(stream, now, data, true)
+		o.tailBytes[stream] += len(data)
+		o.trim(stream, tailSize)
+	}
+}
+
+func (o *combinedOutput) add(stream int, now time.Time, data []byte, tail bool) {
+	offset := now.Sub(o.start)
+	if offset < 0 {
+		offset = 0
+	}
+	o.chunks = append(o.chunks, OutputChunk{
+		Stream: stream,
+		Time:   now,
+		Offset: offset,
+		Data:   append([]byte(nil), data...),
+	})
+	o.tail = append(o.tail, tail)
+}
+
+// trim drops the oldest tail bytes of stream beyond size.
+func (o *combinedOutput) trim(stream, size int) {
+	for over := o.tailBytes[stream] - size; over > 0; {
+		i := o.oldest[stream]
+		for o.chunks[i].Stream != stream || !o.tail[i] || len(o.chunks[i].Data) == 0 {
+			i++
+		}
+		o.oldest[stream] = i
+		chunk := &o.chunks[i]
+		if n := len(chunk.Data); n > over {
+			chunk.Data = chunk.Data[over:]
+			o.tailBytes[stream] -= over
+			break
+		}
+		over -= len(chunk.Data)
+		o.tailBytes[stream] -= len(chunk.Data)
+		chunk.Data = nil
+		o.empty++
+	}
+	if o.empty > 64 && o.empty > len(o.chunks)/2 {
+		o.compact()
+	}
+}
+
+func (o *combinedOutput) compact() {
+	n := 0
+	for i, chunk := range o.chunks {
+		if len(chunk.Data) > 0 {
+			o.chunks[n] = chunk
+			o.tail[n] = o.tail[i]
+			n++
+		}
+	}
+	for i := n; i < len(o.chunks); i++ {
+		o.chunks[i] = OutputChunk{}
+	}
+	o.chunks = o.chunks[:n]
+	o.tail = o.tail[:n]
+	o.empty = 0
+	o.oldest = [3]int{}
+}
+
+// rebase moves the start to start. Output read before it is at offset 0.
+func (o *combinedOutput) rebase(start time.Time) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	shift := start.Sub(o.start)
+	o.start = start
+	for i := range o.chunks {
+		if o.chunks[i].Offset -= shift; o.chunks[i].Offset < 0 {
+			o.chunks[i].Offset = 0
+		}
+	}
+}
+
+func (o *combinedOutput) between(from, to time.Duration) []OutputChunk {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	var chunks []OutputChunk
+	for _, chunk := range o.chunks {
+		if len(chunk.Data) > 0 && chunk.Offset >= from && chunk.Offset < to {
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
+
+// SetCombinedOutput records stdout and stderr interleaved as they are read,
+// each chunk with its stream and time, see GetCombinedOutput. Like GetOutput
+// it keeps the bytes of each stream allowed by SetCaptureLimit, though
+// without a truncation marker and without spilling the rest.
+func (c *Cmd) SetCombinedOutput(enabled bool) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.combined = enabled
+	return c
+}
+
+// startCombined hooks a fresh combined capture into the output readers
+// before they are started. The caller holds c.lock.
+func (c *Cmd) startCombined() {
+	c.combinedOut = nil
+	if !c.combined {
+		return
+	}
+	c.combinedOut = &combinedOutput{start: time.Now()}
+	c.combinedOut.limits[STDOUT] = c.stdoutLimit
+	c.combinedOut.limits[STDERR] = c.stderrLimit
+	c.stdoutbuf.addObserver(c.combinedOut.observer(STDOUT))
+	c.stderrbuf.addObserver(c.combinedOut.observer(STDERR))
+}
+
+// releaseCombined starts the offsets of the combined output when the
+// subprocess held by Command is released. The caller holds c.lock.
+func (c *Cmd) releaseCombined() {
+	if c.combinedOut != nil {
+		c.combinedOut.rebase(time.Now())
+	}
+}
+
+func (c *Cmd) combinedOutput() *combinedOutput {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.combinedOut
+}
+
+// GetCombinedOutput returns the output of the current or last command in
+// the order it was read. It is empty unless SetCombinedOutput was enabled.
+func (c *Cmd) GetCombinedOutput() []OutputChunk {
+	return c.GetCombinedOutputBetween(0, 1<<63-1)
+}
+
+// GetCombinedOutputBetween returns the chunks read from offset from up to
+// but not including offset to, both relative to the start of the command.
+func (c *Cmd) GetCombinedOutputBetween(from, to time.Duration) []OutputChunk {
+	o := c.combinedOutput()
+	if o == nil {
+		return nil
+	}
+	return o.between(from, to)
+}
+
+// GetCombinedBytes returns stdout and stderr merged as a terminal would
+// have shown them.
+func (c *Cmd) GetCombinedBytes() []byte {
+	var buf bytes.Buffer
+	for _, chunk := range c.GetCombinedOutput() {
+		buf.Write(chunk.Data)
+	}
+	return buf.Bytes()
+}
+
+type outputChunkJSON struct {
+	Time   time.Time `json:"time"`
+	Offset int64     `json:"offset_ns"`
+	Stream string    `json:"stream"`
+	Data   string    `json:"data,omitempty"`
+	Base64 string    `json:"data_base64,omitempty"`
+}
+
+// WriteCombinedJSONLines writes the combined output to w as one JSON object
+// per chunk and line:
+//
+//	{"time":"...","offset_ns":1500000,"stream":"stderr","data":"error\n"}
+//
+// Chunks that are not valid UTF-8 carry their data in data_base64 instead.
+func (c *Cmd) WriteCombinedJSONLines(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, chunk := range c.GetCombinedOutput() {
+		line := outputChunkJSON{
+			Time:   chunk.Time,
+			Offset: int64(chunk.Offset),
+			Stream: "stdout",
+		}
+		if chunk.Stream == STDERR {
+			line.Stream = "stderr"
+		}
+		if utf8.Valid(chunk.Data) {
+			line.Data = string(chunk.Data)
+		} else {
+			line.Base64 = base64.StdEncoding.EncodeToString(chunk.Data)
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
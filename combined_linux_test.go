@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCmdCombinedOutput(t *testing.T) {
+	cmd := NewCmd().SetCombinedOutput(true)
+	defer cmd.Close()
+	_, err := cmd.RunCommandResult("/bin/sh", "-c",
+		"echo one; echo two >&2; echo three; printf '\\377' >&2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the pipes are read concurrently, so only the order within a stream
+	// is known
+	chunks := cmd.GetCombinedOutput()
+	var streams [2][]byte
+	var all []byte
+	for i, chunk := range chunks {
+		if i > 0 && chunk.Offset < chunks[i-1].Offset {
+			t.Fatalf("chunk %d out of order", i)
+		}
+		streams[chunk.Stream-STDOUT] = append(streams[chunk.Stream-STDOUT], chunk.Data...)
+		all = append(all, chunk.Data...)
+	}
+	if string(streams[0]) != "one\nthree\n" || string(streams[1]) != "two\n\377" {
+		t.Fatalf("unexpected output %q %q", streams[0], streams[1])
+	}
+	if got := cmd.GetCombinedBytes(); !bytes.Equal(got, all) {
+		t.Fatalf("unexpected combined output %q", got)
+	}
+
+	last := chunks[len(chunks)-1].Offset
+	if got := cmd.GetCombinedOutputBetween(0, last+1); len(got) != len(chunks) {
+		t.Fatalf("unexpected slice %+v", got)
+	}
+	if got := cmd.GetCombinedOutputBetween(last+1, last+2); len(got) != 0 {
+		t.Fatalf("unexpected slice %+v", got)
+	}
+
+	var buf bytes.Buffer
+	if err := cmd.WriteCombinedJSONLines(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var lines []outputChunkJSON
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var line outputChunkJSON
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != len(chunks) {
+		t.Fatalf("unexpected json lines %+v", lines)
+	}
+	for i, line := range lines {
+		chunk := chunks[i]
+		data := []byte(line.Data)
+		if line.Base64 != "" {
+			if data, err = base64.StdEncoding.DecodeString(line.Base64); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stream := map[int]string{STDOUT: "stdout", STDERR: "stderr"}[chunk.Stream]
+		if line.Stream != stream || !bytes.Equal(data, chunk.Data) ||
+			time.Duration(line.Offset) != chunk.Offset {
+			t.Fatalf("json line %d %+v for %+v", i, line, chunk)
+		}
+	}
+
+	// disabled by default
+	cmd2 := NewCmd()
+	defer cmd2.Close()
+	if _, err := cmd2.RunCommandResult("echo", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if chunks := cmd2.GetCombinedOutput(); chunks != nil {
+		t.Fatalf("unexpected chunks %+v", chunks)
+	}
+
+	// bounded by the capture limits, offsets start when released
+	cmd3 := NewCmd().SetCombinedOutput(true).
+		SetCaptureLimit(STDOUT, CaptureLimit{Size: 4, Policy: CaptureTail}).
+		SetCaptureLimit(STDERR, CaptureLimit{Size: 3})
+	defer cmd3.Close()
+	if _, err := cmd3.Command("/bin/sh", "-c", "echo abc; echo def >&2; echo ghi"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	released := time.Now()
+	if _, err := cmd3.RunResult(); err != nil {
+		t.Fatal(err)
+	}
+	// nothing is output while held, every offset is within the run
+	sinceRelease := time.Since(released)
+	var stdout, stderr []byte
+	for _, chunk := range cmd3.GetCombinedOutput() {
+		if chunk.Offset > sinceRelease {
+			t.Fatalf("offset %v includes the hold", chunk.Offset)
+		}
+		if chunk.Stream == STDOUT {
+			stdout = append(stdout, chunk.Data...)
+		} else {
+			stderr = append(stderr, chunk.Data...)
+		}
+	}
+	if string(stdout) != "ghi\n" || string(stderr) != "def" {
+		t.Fatalf("unexpected output %q %q", stdout, stderr)
+	}
+}
+
+func TestCombinedOutputLimit(t *testing.T) {
+	o := &combinedOutput{start: time.Now()}
+	o.limits[STDOUT] = CaptureLimit{Size: 10, Policy: CaptureHeadTail}
+	o.limits[STDERR] = CaptureLimit{Size: 1, Policy: CaptureTail}
+	out, errOut := o.observer(STDOUT), o.observer(STDERR)
+	var all strings.Builder
+	for i := 0; i < 500; i++ {
+		b := []byte{byte('a' + i%26)}
+		all.Write(b)
+		out(b)
+		errOut(b)
+	}
+	var stdout, stderr []byte
+	for _, chunk := range o.between(0, 1<<63-1) {
+		if chunk.Stream == STDOUT {
+			stdout = append(stdout, chunk.Data...)
+		} else {
+			stderr = append(stderr, chunk.Data...)
+		}
+	}
+	want := all.String()[:5] + all.String()[495:]
+	if string(stdout) != want || string(stderr) != all.String()[499:] {
+		t.Fatalf("unexpected output %q %q", stdout, stderr)
+	}
+	// the emptied chunks are compacted
+	if len(o.chunks) > 100 {
+		t.Fatalf("%d chunks kept", len(o.chunks))
+	}
+}
@@ -1 +1,174 @@
 package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// readerStopDelay is how long the reader goroutines may keep draining the
+// pipes after the context is done before the pipes are closed under them,
+// e.g. when a grandchild inherited stdout and keeps it open.
+const readerStopDelay = 2 * time.Second
+
+// LineHandler is called from the reader goroutine for every line the
+// subprocess writes, while it is still running.
+type LineHandler func(line string)
+
+func (c *Cmd) OnStdoutLine(handler LineHandler) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stdoutLine = handler
+	return c
+}
+
+func (c *Cmd) OnStderrLine(handler LineHandler) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stderrLine = handler
+	return c
+}
+
+// SetStdoutWriter tees stdout to w as it is read.
+func (c *Cmd) SetStdoutWriter(w io.Writer) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stdoutTee = w
+	return c
+}
+
+// SetStderrWriter tees stderr to w as it is read.
+func (c *Cmd) SetStderrWriter(w io.Writer) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stderrTee = w
+	return c
+}
+
+// handleReader captures the output of one pipe until it is closed, tees the
+// raw chunks and passes complete lines to onLine.
+func (c *Cmd) handleReader(r *IOReadCloser, onLine LineHandler, tee io.Writer) {
+	defer c.wg.Done()
+	lines := NewLineSplitter(func(line []byte) {
+		if c.debug {
+			log.Infof("%s", line)
+		}
+		if onLine != nil {
+			onLine(strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"))
+		}
+	})
+	for {
+		chunk, err := r.ReadChunk()
+		if len(chunk) > 0 {
+			if tee != nil {
+				if _, werr := tee.Write(chunk); werr != nil && c.debug {
+					log.Error(werr)
+				}
+			}
+			lines.Write(chunk)
+		}
+		if err != nil {
+			lines.Flush()
+			if c.debug {
+				if errors.Is(err, io.EOF) {
+					log.Info("Read EOF")
+				} else {
+					log.Info(err)
+				}
+			}
+			return
+		}
+	}
+}
+
+// wait reaps the subprocess once the reader goroutines are done and
+// closes done. It runs from Command so the process is always waited for,
+// whether or not Run is called.
+func (c *Cmd) wait(cmd *exec.Cmd, done chan struct{}) {
+	c.wg.Wait()
+	c.lock.RLock()
+	if c.expect != nil {
+		c.expect.close()
+	}
+	c.lock.RUnlock()
+	err := cmd.Wait()
+	c.lock.Lock()
+	c.waitErr = err
+	c.exitTime = time.Now()
+	c.lock.Unlock()
+	close(done)
+}
+
+// waitContext blocks until the subprocess has exited. When ctx is done
+// first the subprocess is stopped with the stop policy.
+func (c *Cmd) waitContext(ctx context.Context) error {
+	c.lock.RLock()
+	done := c.waitDone
+	c.lock.RUnlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		c.lock.Lock()
+		if c.ctxErr == nil {
+			c.ctxErr = ctx.Err()
+		}
+		cancel := c.cancel
+		c.lock.Unlock()
+		cancel()
+		<-done
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.waitErr
+}
+
+// watchContext stops the subprocess when ctx is done and makes sure the
+// reader goroutines return even if the pipes are kept open.
+func (c *Cmd) watchContext(ctx context.Context, done <-chan struct{}) {
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+	c.terminate(context.Background(), done)
+	c.drain(done)
+}
+
+// drain waits for done and closes the pipes under the reader goroutines
+// if they are still blocked after readerStopDelay, e.g. because a
+// grandchild inherited stdout and keeps it open.
+func (c *Cmd) drain(done <-chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(readerStopDelay):
+		c.lock.RLock()
+		defer c.lock.RUnlock()
+		if c.stdout != nil {
+			c.stdout.Close()
+		}
+		if c.stderr != nil {
+			c.stderr.Close()
+		}
+	}
+}
+
+// contextErr reports why the subprocess context ended, preferring the
+// context passed to RunContext over the one from CommandContext.
+func (c *Cmd) contextErr() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.ctxErr != nil {
+		return c.ctxErr
+	}
+	if c.ctx != nil {
+		return c.ctx.Err()
+	}
+	return nil
+}
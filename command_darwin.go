@@ -18,28 +18,49 @@ import (
 )
 
 type Cmd struct {
-	user        *UserAccount
-	debug       bool
-	stdoutbuf   *IOReadCloser
-	stderrbuf   *IOReadCloser
-	wg          sync.WaitGroup
-	pid         int
-	cmd         *exec.Cmd
-	timeout     time.Duration
-	workDir     string
-	ctx         context.Context
-	cancel      context.CancelFunc
-	procAttr    *syscall.SysProcAttr
-	credential  *syscall.Credential
-	stdout      io.ReadCloser
-	stderr      io.ReadCloser
-	stdin       io.WriteCloser
-	stdinChan   chan string
-	running     bool
-	lock        sync.RWMutex
-	env         []string
-	noSetGroups bool
-	stop        chan bool
+	user         *UserAccount
+	debug        bool
+	stdoutbuf    *IOReadCloser
+	stderrbuf    *IOReadCloser
+	wg           sync.WaitGroup
+	pid          int
+	cmd          *exec.Cmd
+	timeout      time.Duration
+	workDir      string
+	ctx          context.Context
+	cancel       context.CancelFunc
+	ctxErr       error
+	stopPolicy   StopPolicy
+	stopStep     StopStep
+	waitDone     chan struct{}
+	trace        *traceHold
+	waitErr      error
+	exitTime     time.Time
+	processGroup ProcessGroup
+	procAttr     *syscall.SysProcAttr
+	credential   *syscall.Credential
+	stdout       io.ReadCloser
+	stderr       io.ReadCloser
+	stdin        io.WriteCloser
+	expect       *expectBuffer
+	expectOn     bool
+	autoAnswers  []autoAnswer
+	transcript   bool
+	combined     bool
+	combinedOut  *combinedOutput
+	stdoutLimit  CaptureLimit
+	stderrLimit  CaptureLimit
+	stdinSource  io.Reader
+	stdinErr     error
+	stdinDone    chan struct{}
+	lock         sync.RWMutex
+	env          []string
+	noSetGroups  bool
+	stop         chan bool
+	stdoutLine   LineHandler
+	stderrLine   LineHandler
+	stdoutTee    io.Writer
+	stderrTee    io.Writer
 }
 
 func NewCmd() *Cmd {
@@ -58,12 +79,14 @@ func NewCmd() *Cmd {
 		stdout:      nil,
 		stderr:      nil,
 		stdin:       nil,
-		stdinChan:   make(chan string),
-		running:     false,
 		lock:        sync.RWMutex{},
 		env:         nil,
 		noSetGroups: false,
 		stop:        make(chan bool),
+		stdoutLine:  nil,
+		stderrLine:  nil,
+		stdoutTee:   nil,
+		stderrTee:   nil,
 	}
 	runtime.SetFinalizer(c, (*Cmd).Close)
 	return c
@@ -106,12 +129,14 @@ func NewCommand() *Cmd {
 		stdout:      nil,
 		stderr:      nil,
 		stdin:       nil,
-		stdinChan:   make(chan string),
-		running:     false,
 		lock:        sync.RWMutex{},
 		env:         nil,
 		noSetGroups: false,
 		stop:        make(chan bool),
+		stdoutLine:  nil,
+		stderrLine:  nil,
+		stdoutTee:   nil,
+		stderrTee:   nil,
 	}
 	runtime.SetFinalizer(c, (*Cmd).Close)
 	return c
@@ -153,8 +178,16 @@ func (c *Cmd) SetDebug(debug bool) *Cmd {
 }
 
 func (c *Cmd) Mkdir(path string, perm os.FileMode) (output []byte, err error) {
+	res, err := c.MkdirResult(path, perm)
+	if res != nil {
+		output = res.Stdout
+	}
+	return
+}
+
+func (c *Cmd) MkdirResult(path string, perm os.FileMode) (res *Result, err error) {
 	args := []string{"-p", path, "-m", "=" + perm.String()}
-	output, err = c.RunCommand("mkdir", args...)
+	res, err = c.RunCommandResult("mkdir", args...)
 	if err != nil {
 		if c.debug {
 			log.Error(err.Error())
@@ -172,50 +205,38 @@ func (c *Cmd) RunCommand(cmdl string, args ...string) (output []byte, err error)
 	return c.Run()
 }
 
+func (c *Cmd) RunCommandResult(cmdl string, args ...string) (*Result, error) {
+	_, err := c.Command(cmdl, args...)
+	if err != nil {
+		return nil, err
+	}
+	return c.RunResult()
+}
+
 func (c *Cmd) GetPid() int {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 	return c.pid
 }
 
+// Resume lets the subprocess held by Command run the command, or continues
+// it after Pause.
 func (c *Cmd) Resume() error {
+	c.lock.Lock()
+	trace := c.trace
+	c.trace = nil
+	if trace != nil {
+		c.releaseCombined()
+	}
+	c.lock.Unlock()
+	if err := trace.release(); err != nil {
+		return newStartError(c.cmd.Args[0], err)
+	}
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	// resume subprocess
 	return c.cmd.Process.Signal(syscall.SIGCONT)
 }
 
-func (c *Cmd) checkProcStateIsRunning() {
-	for {
-		if c.running {
-			run, err := CheckProcStateIsStopped(c.pid)
-			if err != nil {
-				if c.debug {
-					log.Error(err)
-				}
-
-			}
-			if !run {
-				err = c.Resume()
-				if err != nil {
-					if errors.Is(err, os.ErrProcessDone) {
-						break
-					}
-					if c.debug {
-						log.Error(err)
-					}
-				}
-				c.running = true
-			} else {
-				break
-			}
-		} else {
-			break
-		}
-		time.Sleep(3 * time.Second)
-	}
-}
-
 func (c *Cmd) GetUser() *UserAccount {
 	return c.user
 }
@@ -234,26 +255,48 @@ func (c *Cmd) SetUsername(username string) error {
 }
 
 func (c *Cmd) Run() (output []byte, err error) {
+	return c.RunContext(context.Background())
+}
+
+func (c *Cmd) RunContext(ctx context.Context) (output []byte, err error) {
+	res, err := c.RunResultContext(ctx)
+	if res == nil {
+		return nil, err
+	}
+	return res.Stdout, err
+}
+
+func (c *Cmd) RunResult() (res *Result, err error) {
+	return c.RunResultContext(context.Background())
+}
+
+func (c *Cmd) RunResultContext(ctx context.Context) (res *Result, err error) {
 	if c.cmd.Process == nil {
 		if c.debug {
 			log.Error("subprocess already exited")
 		}
-		return nil, errors.New("subprocess already exited")
+		return nil, ErrSubprocessExited
 	}
+	// before the release, a short command may exit right after it
+	started := time.Now()
 	err = c.Resume()
 	if err != nil {
 		if !errors.Is(err, os.ErrProcessDone) {
 			return nil, err
 		}
 	}
-	c.wg.Wait()
-
-	if err = c.cmd.Wait(); err != nil {
+	res = &Result{
+		Pid:       c.GetPid(),
+		StartTime: started,
+	}
+	err = c.waitContext(ctx)
+	c.finishResult(res)
+	if err != nil {
 		if errors.Is(err, os.ErrProcessDone) {
 			if c.debug {
 				log.Infof("Process done: %s", err.Error())
 			}
-			return c.stdoutbuf.Bytes(), nil
+			return res, nil
 		}
 		if exiterr, ok := err.(*exec.ExitError); ok {
 			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
@@ -261,16 +304,16 @@ func (c *Cmd) Run() (output []byte, err error) {
 					log.Infof("Exit Status: %d", status.ExitStatus())
 				}
 
-				return c.stdoutbuf.Bytes(), err
+				return res, c.waitError(res, err)
 			}
 		}
 		if c.debug {
 			log.Error(err.Error())
 		}
-		return c.stdoutbuf.Bytes(), err
+		return res, c.waitError(res, err)
 	}
 
-	return c.GetOutput()
+	return res, nil
 }
 
 func (c *Cmd) Close() error {
@@ -285,6 +328,12 @@ func (c *Cmd) Close() error {
 	if c.stdin != nil {
 		c.stdin.Close()
 	}
+	// a subprocess still held by Command does not run on
+	if c.trace != nil {
+		c.cmd.Process.Kill()
+		c.trace.release()
+		c.trace = nil
+	}
 	if c.cancel != nil {
 		c.cancel()
 	}
@@ -305,7 +354,15 @@ func (c *Cmd) SetNoSetGroups(noSetGroups bool) *Cmd {
 	return c
 }
 
+// Command starts the subprocess and holds it until Run or Resume, so its
+// pid can be used before the command runs. It is traced and held at exec,
+// before the command runs a single instruction. A set-user-ID program
+// started by an unprivileged parent runs without its privileges then.
 func (c *Cmd) Command(cmdl string, args ...string) (pid int, err error) {
+	return c.CommandContext(context.Background(), cmdl, args...)
+}
+
+func (c *Cmd) CommandContext(ctx context.Context, cmdl string, args ...string) (pid int, err error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	if c.debug {
@@ -313,11 +370,13 @@ func (c *Cmd) Command(cmdl string, args ...string) (pid int, err error) {
 	}
 
 	if c.timeout > 0 {
-		c.ctx, c.cancel = context.WithTimeout(context.Background(), c.timeout)
-		c.cmd = exec.CommandContext(c.ctx, cmdl, args...)
+		c.ctx, c.cancel = context.WithTimeout(ctx, c.timeout)
 	} else {
-		c.cmd = exec.Command(cmdl, args...)
+		c.ctx, c.cancel = context.WithCancel(ctx)
 	}
+	c.ctxErr = nil
+	c.stopStep = StopNone
+	c.cmd = exec.Command(cmdl, args...)
 
 	if c.procAttr != nil {
 		c.cmd.SysProcAttr = c.procAttr
@@ -349,6 +408,18 @@ func (c *Cmd) Command(cmdl string, args ...string) (pid int, err error) {
 		}
 	}
 
+	if c.processGroup != NoProcessGroup {
+		if c.cmd.SysProcAttr == nil {
+			c.cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		if c.processGroup == NewSession {
+			c.cmd.SysProcAttr.Setsid = true
+		} else {
+			c.cmd.SysProcAttr.Setpgid = true
+			c.cmd.SysProcAttr.Pgid = 0
+		}
+	}
+
 	if c.GetUser().GetUser() != nil {
 		c.cmd.Env = append(os.Environ(), "USER="+c.GetUser().GetUser().Username, "HOME="+c.GetUser().GetUser().HomeDir)
 	} else {
@@ -390,37 +461,45 @@ func (c *Cmd) Command(cmdl string, args ...string) (pid int, err error) {
 	}
 	c.stderrbuf = NewReader(c.stderr)
 
-	c.stdin, err = c.cmd.StdinPipe()
+	stdinR, err := c.stdinPipe()
 	if err != nil {
 		if c.debug {
 			log.Error(err.Error())
 		}
 		return pid, err
 	}
+	defer stdinR.Close()
 
-	if err = c.cmd.Start(); err != nil {
+	trace, err := startTraced(c.cmd)
+	if err != nil {
 		if c.debug {
 			log.Error(err.Error())
 		}
-		return pid, err
+		c.closeStdinPipe()
+		return pid, newStartError(cmdl, err)
 	}
 
 	c.pid = c.cmd.Process.Pid
-	err = c.Pause()
-	if err != nil {
-		return pid, err
-	}
-	c.running = false
+	c.trace = trace
+	c.startCapture()
+	c.startExpect()
+	c.startCombined()
+	c.startStdin()
 	c.wg.Add(1)
-	go c.handleReader(c.stdout, STDOUT)
+	go c.handleReader(c.stdoutbuf, c.stdoutLine, c.stdoutTee)
 	c.wg.Add(1)
-	go c.handleReader(c.stderr, STDERR)
-	go c.checkProcStateIsRunning()
+	go c.handleReader(c.stderrbuf, c.stderrLine, c.stderrTee)
+	c.waitDone = make(chan struct{})
+	go func(cmd *exec.Cmd, done chan struct{}) {
+		trace.wait()
+		c.wait(cmd, done)
+	}(c.cmd, c.waitDone)
+	go c.watchContext(c.ctx, c.waitDone)
 	return c.pid, nil
 }
 
+// Pause stops the running subprocess with SIGTSTP until Resume.
 func (c *Cmd) Pause() error {
-	// pause subprocess
 	return c.cmd.Process.Signal(syscall.SIGTSTP)
 }
 
@@ -436,6 +515,10 @@ func (c *Cmd) GetStderrOutput() ([]byte, error) {
 	return c.stderrbuf.Bytes(), nil
 }
 
+// NeedInput prints text and forwards a line read from os.Stdin to the
+// subprocess.
+//
+// Deprecated: use Expect and SendLine.
 func (c *Cmd) NeedInput(text string) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -453,59 +536,6 @@ func (c *Cmd) NeedInput(text string) {
 	}
 }
 
-func (c *Cmd) handleReader(std io.ReadCloser, stdio int) {
-	defer func() {
-		c.wg.Done()
-	}()
-
-	for {
-		var err error
-		var str string
-		if stdio == STDOUT {
-			str, err = c.stdoutbuf.Read()
-		} else if stdio == STDERR {
-			str, err = c.stderrbuf.Read()
-		}
-		if err != nil {
-			if errors.Is(err, io.ErrClosedPipe) {
-				if c.debug {
-					log.Info(err)
-				}
-				return
-			} else if errors.Is(err, os.ErrClosed) {
-				if c.debug {
-					log.Info(err)
-				}
-				return
-			} else if errors.Is(err, os.ErrDeadlineExceeded) {
-				if c.debug {
-					log.Info(err)
-				}
-				return
-			} else if errors.Is(err, io.ErrUnexpectedEOF) {
-				if c.debug {
-					log.Info(err)
-				}
-				return
-			} else if errors.Is(err, io.EOF) {
-				if c.debug {
-					log.Info("Read EOF")
-				}
-				return
-			} else {
-				if c.debug {
-					log.Error(err)
-				}
-				break
-			}
-		}
-
-		if c.debug {
-			log.Infof("%s", str)
-		}
-	}
-}
-
 func (c *Cmd) CheckRoot() error {
 	user, err := user.Current()
 	if err != nil {
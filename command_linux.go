@@ -18,28 +18,69 @@ import (
 )
 
 type Cmd struct {
-	user        *UserAccount
-	debug       bool
-	stdoutbuf   *IOReadCloser
-	stderrbuf   *IOReadCloser
-	wg          sync.WaitGroup
-	pid         int
-	cmd         *exec.Cmd
-	timeout     time.Duration
-	workDir     string
-	ctx         context.Context
-	cancel      context.CancelFunc
-	procAttr    *syscall.SysProcAttr
-	credential  *syscall.Credential
-	stdout      io.ReadCloser
-	stderr      io.ReadCloser
-	stdin       io.WriteCloser
-	stdinChan   chan string
-	running     bool
-	lock        sync.RWMutex
-	env         []string
-	noSetGroups bool
-	stop        chan bool
+	user         *UserAccount
+	debug        bool
+	stdoutbuf    *IOReadCloser
+	stderrbuf    *IOReadCloser
+	wg           sync.WaitGroup
+	pid          int
+	cmd          *exec.Cmd
+	timeout      time.Duration
+	workDir      string
+	ctx          context.Context
+	cancel       context.CancelFunc
+	ctxErr       error
+	stopPolicy   StopPolicy
+	stopStep     StopStep
+	waitDone     chan struct{}
+	initPipe     *childInitPipe
+	trace        *traceHold
+	sampleEvery  time.Duration
+	sampler      *resourceSampler
+	pidfd        *os.File
+	exited       chan struct{}
+	waitErr      error
+	exitTime     time.Time
+	processGroup ProcessGroup
+	rlimits      []Rlimit
+	cgroup       *CgroupConfig
+	cgroupPath   string
+	namespaces   Namespace
+	uidMappings  []syscall.SysProcIDMap
+	gidMappings  []syscall.SysProcIDMap
+	hostname     string
+	seccomp      []*SeccompFilter
+	landlock     []landlockRule
+	landlockMode LandlockMode
+	capabilities *CapSet
+	pty          bool
+	ptyMaster    *os.File
+	ptySlave     *os.File
+	winSize      WindowSize
+	procAttr     *syscall.SysProcAttr
+	credential   *syscall.Credential
+	stdout       io.ReadCloser
+	stderr       io.ReadCloser
+	stdin        io.WriteCloser
+	expect       *expectBuffer
+	expectOn     bool
+	autoAnswers  []autoAnswer
+	transcript   bool
+	combined     bool
+	combinedOut  *combinedOutput
+	stdoutLimit  CaptureLimit
+	stderrLimit  CaptureLimit
+	stdinSource  io.Reader
+	stdinErr     error
+	stdinDone    chan struct{}
+	lock         sync.RWMutex
+	env          []string
+	noSetGroups  bool
+	stop         chan bool
+	stdoutLine   LineHandler
+	stderrLine   LineHandler
+	stdoutTee    io.Writer
+	stderrTee    io.Writer
 }
 
 func NewCmd() *Cmd {
@@ -58,12 +99,14 @@ func NewCmd() *Cmd {
 		stdout:      nil,
 		stderr:      nil,
 		stdin:       nil,
-		stdinChan:   make(chan string),
-		running:     false,
 		lock:        sync.RWMutex{},
 		env:         nil,
 		noSetGroups: false,
 		stop:        make(chan bool),
+		stdoutLine:  nil,
+		stderrLine:  nil,
+		stdoutTee:   nil,
+		stderrTee:   nil,
 	}
 	runtime.SetFinalizer(c, (*Cmd).Close)
 	return c
@@ -71,47 +114,28 @@ func NewCmd() *Cmd {
 
 func NewCommand() *Cmd {
 	c := &Cmd{
-		user:      NewUserAccount(),
-		debug:     false,
-		stdoutbuf: nil,
-		stderrbuf: nil,
-		wg:        sync.WaitGroup{},
-		pid:       0,
-		cmd:       &exec.Cmd{},
-		timeout:   0,
-		workDir:   "",
-		// procAttr: &syscall.SysProcAttr{
-		// Cloneflags:                 syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET,
-		// GidMappingsEnableSetgroups: true,
-		// Setpgid: true,
-		// UidMappings: []syscall.SysProcIDMap{
-		// 	{
-		// 		ContainerID: 0,
-		// 		HostID:      0,
-		// 		Size:        1,
-		// 	},
-		// },
-		// GidMappings: []syscall.SysProcIDMap{
-		// 	{
-		// 		ContainerID: 0,
-		// 		HostID:      0,
-		// 		Size:        1,
-		// 	},
-		// },
-		// 	Pgid:       0,
-		// 	Credential: &syscall.Credential{},
-		// },
+		user:        NewUserAccount(),
+		debug:       false,
+		stdoutbuf:   nil,
+		stderrbuf:   nil,
+		wg:          sync.WaitGroup{},
+		pid:         0,
+		cmd:         &exec.Cmd{},
+		timeout:     0,
+		workDir:     "",
 		procAttr:    nil,
 		credential:  nil,
 		stdout:      nil,
 		stderr:      nil,
 		stdin:       nil,
-		stdinChan:   make(chan string),
-		running:     false,
 		lock:        sync.RWMutex{},
 		env:         nil,
 		noSetGroups: false,
 		stop:        make(chan bool),
+		stdoutLine:  nil,
+		stderrLine:  nil,
+		stdoutTee:   nil,
+		stderrTee:   nil,
 	}
 	runtime.SetFinalizer(c, (*Cmd).Close)
 	return c
@@ -153,8 +177,16 @@ func (c *Cmd) SetDebug(debug bool) *Cmd {
 }
 
 func (c *Cmd) Mkdir(path string, perm os.FileMode) (output []byte, err error) {
+	res, err := c.MkdirResult(path, perm)
+	if res != nil {
+		output = res.Stdout
+	}
+	return
+}
+
+func (c *Cmd) MkdirResult(path string, perm os.FileMode) (res *Result, err error) {
 	args := []string{"-p", path, "-m", "=" + perm.String()}
-	output, err = c.RunCommand("mkdir", args...)
+	res, err = c.RunCommandResult("mkdir", args...)
 	if err != nil {
 		if c.debug {
 			log.Error(err.Error())
@@ -172,48 +204,27 @@ func (c *Cmd) RunCommand(cmdl string, args ...string) (output []byte, err error)
 	return c.Run()
 }
 
+func (c *Cmd) RunCommandResult(cmdl string, args ...string) (*Result, error) {
+	_, err := c.Command(cmdl, args...)
+	if err != nil {
+		return nil, err
+	}
+	return c.RunResult()
+}
+
 func (c *Cmd) GetPid() int {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 	return c.pid
 }
 
+// Resume lets the subprocess held by Command run the command, or continues
+// it after Pause.
 func (c *Cmd) Resume() error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	// resume subprocess
-	return c.cmd.Process.Signal(syscall.SIGCONT)
-}
-
-func (c *Cmd) checkProcStateIsRunning() {
-	for {
-		if c.running {
-			run, err := CheckProcStateIsStopped(c.pid)
-			if err != nil {
-				if c.debug {
-					log.Error(err)
-				}
-
-			}
-			if !run {
-				err = c.Resume()
-				if err != nil {
-					if errors.Is(err, os.ErrProcessDone) {
-						break
-					}
-					if c.debug {
-						log.Error(err)
-					}
-				}
-				c.running = true
-			} else {
-				break
-			}
-		} else {
-			break
-		}
-		time.Sleep(3 * time.Second)
+	if err := c.releaseChild(); err != nil {
+		return newStartError(c.cmd.Args[0], c.landlockError(err))
 	}
+	return c.sendSignal(c.cmd.Process, syscall.SIGCONT)
 }
 
 func (c *Cmd) GetUser() *UserAccount {
@@ -234,26 +245,63 @@ func (c *Cmd) SetUsername(username string) error {
 }
 
 func (c *Cmd) Run() (output []byte, err error) {
+	return c.RunContext(context.Background())
+}
+
+func (c *Cmd) RunContext(ctx context.Context) (output []byte, err error) {
+	res, err := c.RunResultContext(ctx)
+	if res == nil {
+		return nil, err
+	}
+	return res.Stdout, err
+}
+
+func (c *Cmd) RunResult() (res *Result, err error) {
+	return c.RunResultContext(context.Background())
+}
+
+func (c *Cmd) RunResultContext(ctx context.Context) (res *Result, err error) {
 	if c.cmd.Process == nil {
 		if c.debug {
 			log.Error("subprocess already exited")
 		}
-		return nil, errors.New("subprocess already exited")
+		return nil, ErrSubprocessExited
 	}
+	// before the release, a short command may exit right after it
+	started := time.Now()
 	err = c.Resume()
 	if err != nil {
+		var startErr *StartError
+		if errors.As(err, &startErr) {
+			if c.debug {
+				log.Error(err.Error())
+			}
+			c.waitContext(ctx)
+			c.lock.Lock()
+			c.removeCgroup()
+			c.lock.Unlock()
+			return nil, err
+		}
 		if !errors.Is(err, os.ErrProcessDone) {
 			return nil, err
 		}
 	}
-	c.wg.Wait()
-
-	if err = c.cmd.Wait(); err != nil {
+	c.startSampler()
+	res = &Result{
+		Pid:       c.GetPid(),
+		StartTime: started,
+	}
+	err = c.waitContext(ctx)
+	c.finishResult(res)
+	res.Limit = c.exceededLimit(res)
+	c.finishCgroup(res)
+	c.finishUsage(res)
+	if err != nil {
 		if errors.Is(err, os.ErrProcessDone) {
 			if c.debug {
 				log.Infof("Process done: %s", err.Error())
 			}
-			return c.stdoutbuf.Bytes(), nil
+			return res, nil
 		}
 		if exiterr, ok := err.(*exec.ExitError); ok {
 			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
@@ -261,16 +309,16 @@ func (c *Cmd) Run() (output []byte, err error) {
 					log.Infof("Exit Status: %d", status.ExitStatus())
 				}
 
-				return c.stdoutbuf.Bytes(), err
+				return res, c.waitError(res, err)
 			}
 		}
 		if c.debug {
 			log.Error(err.Error())
 		}
-		return c.stdoutbuf.Bytes(), err
+		return res, c.waitError(res, err)
 	}
 
-	return c.GetOutput()
+	return res, nil
 }
 
 func (c *Cmd) Close() error {
@@ -285,9 +333,19 @@ func (c *Cmd) Close() error {
 	if c.stdin != nil {
 		c.stdin.Close()
 	}
+	// a subprocess still held by Command does not run on
+	if c.trace != nil {
+		signalPidfd(c.pidfd, c.cmd.Process, syscall.SIGKILL)
+		c.trace.release()
+		c.trace = nil
+	}
+	c.initPipe.close()
+	c.initPipe = nil
+	c.closePidfd()
 	if c.cancel != nil {
 		c.cancel()
 	}
+	c.removeCgroup()
 	return nil
 }
 
@@ -305,7 +363,18 @@ func (c *Cmd) SetNoSetGroups(noSetGroups bool) *Cmd {
 	return c
 }
 
+// Command starts the subprocess and holds it until Run or Resume, so its
+// pid can be used, e.g. to watch it, before the command runs. It is traced
+// and held at exec, before the command runs a single instruction. With
+// settings applied before exec, e.g. rlimits, or where it cannot be traced,
+// e.g. a set-user-ID program started by an unprivileged parent, it is held
+// in the init trampoline before exec instead. Output readers and stdin are
+// already set up.
 func (c *Cmd) Command(cmdl string, args ...string) (pid int, err error) {
+	return c.CommandContext(context.Background(), cmdl, args...)
+}
+
+func (c *Cmd) CommandContext(ctx context.Context, cmdl string, args ...string) (pid int, err error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	if c.debug {
@@ -313,11 +382,13 @@ func (c *Cmd) Command(cmdl string, args ...string) (pid int, err error) {
 	}
 
 	if c.timeout > 0 {
-		c.ctx, c.cancel = context.WithTimeout(context.Background(), c.timeout)
-		c.cmd = exec.CommandContext(c.ctx, cmdl, args...)
+		c.ctx, c.cancel = context.WithTimeout(ctx, c.timeout)
 	} else {
-		c.cmd = exec.Command(cmdl, args...)
+		c.ctx, c.cancel = context.WithCancel(ctx)
 	}
+	c.ctxErr = nil
+	c.stopStep = StopNone
+	c.cmd = exec.Command(cmdl, args...)
 
 	if c.procAttr != nil {
 		c.cmd.SysProcAttr = c.procAttr
@@ -349,6 +420,25 @@ func (c *Cmd) Command(cmdl string, args ...string) (pid int, err error) {
 		}
 	}
 
+	if c.processGroup != NoProcessGroup {
+		if c.cmd.SysProcAttr == nil {
+			c.cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		if c.processGroup == NewSession {
+			c.cmd.SysProcAttr.Setsid = true
+		} else {
+			c.cmd.SysProcAttr.Setpgid = true
+			c.cmd.SysProcAttr.Pgid = 0
+		}
+	}
+
+	if err = c.applyNamespaces(); err != nil {
+		if c.debug {
+			log.Error(err.Error())
+		}
+		return pid, newStartError(cmdl, err)
+	}
+
 	if c.GetUser().GetUser() != nil {
 		c.cmd.Env = append(os.Environ(), "USER="+c.GetUser().GetUser().Username, "HOME="+c.GetUser().GetUser().HomeDir)
 	} else {
@@ -369,59 +459,163 @@ func (c *Cmd) Command(cmdl string, args ...string) (pid int, err error) {
 		c.cmd.Dir = curDir
 	}
 
-	// syscall.Setgid(c.gid)
-	// syscall.Setuid(c.uid)
-	// syscall.Setreuid(-1, c.uid)
-	c.stdout, err = c.cmd.StdoutPipe()
-	if err != nil {
+	if err = c.createCgroup(); err != nil {
 		if c.debug {
 			log.Error(err.Error())
 		}
-		return pid, err
+		return pid, newStartError(cmdl, err)
 	}
-	c.stdoutbuf = NewReader(c.stdout)
 
-	c.stderr, err = c.cmd.StderrPipe()
+	cgroupFD, err := c.openCgroupFD()
 	if err != nil {
 		if c.debug {
 			log.Error(err.Error())
 		}
-		return pid, err
+		c.removeCgroup()
+		return pid, newStartError(cmdl, err)
+	}
+	if cgroupFD != nil {
+		defer cgroupFD.Close()
+		attr := syscall.SysProcAttr{}
+		if c.cmd.SysProcAttr != nil {
+			attr = *c.cmd.SysProcAttr
+		}
+		attr.UseCgroupFD = true
+		attr.CgroupFD = int(cgroupFD.Fd())
+		c.cmd.SysProcAttr = &attr
 	}
-	c.stderrbuf = NewReader(c.stderr)
 
-	c.stdin, err = c.cmd.StdinPipe()
+	// before the pipes, which are only closed by Start
+	initPipe, err := c.setupChildInit(cgroupFD)
 	if err != nil {
 		if c.debug {
 			log.Error(err.Error())
 		}
-		return pid, err
+		c.removeCgroup()
+		return pid, newStartError(cmdl, err)
 	}
 
-	if err = c.cmd.Start(); err != nil {
+	// syscall.Setgid(c.gid)
+	// syscall.Setuid(c.uid)
+	// syscall.Setreuid(-1, c.uid)
+	if c.pty {
+		if err = c.setupPty(); err != nil {
+			if c.debug {
+				log.Error(err.Error())
+			}
+			initPipe.close()
+			c.removeCgroup()
+			return pid, newStartError(cmdl, err)
+		}
+		defer c.closePtySlave()
+	} else {
+		c.stdout, err = c.cmd.StdoutPipe()
+		if err != nil {
+			if c.debug {
+				log.Error(err.Error())
+			}
+			initPipe.close()
+			c.removeCgroup()
+			return pid, err
+		}
+		c.stdoutbuf = NewReader(c.stdout)
+
+		c.stderr, err = c.cmd.StderrPipe()
+		if err != nil {
+			if c.debug {
+				log.Error(err.Error())
+			}
+			initPipe.close()
+			c.removeCgroup()
+			return pid, err
+		}
+		c.stderrbuf = NewReader(c.stderr)
+
+		stdinR, err := c.stdinPipe()
+		if err != nil {
+			if c.debug {
+				log.Error(err.Error())
+			}
+			initPipe.close()
+			c.removeCgroup()
+			return pid, err
+		}
+		defer stdinR.Close()
+	}
+
+	var trace *traceHold
+	if initPipe == nil {
+		trace, err = startTraced(c.cmd)
+	} else {
+		err = c.cmd.Start()
+	}
+	if err != nil {
 		if c.debug {
 			log.Error(err.Error())
 		}
-		return pid, err
+		initPipe.close()
+		c.closeStdinPipe()
+		c.removeCgroup()
+		return pid, newStartError(cmdl, c.namespaceError(initStartError(initPipe, err)))
 	}
 
-	c.pid = c.cmd.Process.Pid
-	err = c.Pause()
+	c.openPidfd()
+	initPipe.started()
+	// one cloned into the cgroup is in it already
+	if cgroupFD == nil {
+		err = c.joinCgroup(c.cmd.Process.Pid)
+	}
 	if err != nil {
-		return pid, err
+		if c.debug {
+			log.Error(err.Error())
+		}
+		initPipe.close()
+		signalPidfd(c.pidfd, c.cmd.Process, syscall.SIGKILL)
+		trace.release()
+		c.cmd.Wait()
+		c.closePidfd()
+		c.closeStdinPipe()
+		c.removeCgroup()
+		return pid, newStartError(cmdl, err)
 	}
-	c.running = false
-	c.wg.Add(1)
-	go c.handleReader(c.stdout, STDOUT)
+
+	if err = c.waitChildReady(initPipe); err != nil {
+		if c.debug {
+			log.Error(err.Error())
+		}
+		c.closePidfd()
+		c.closeStdinPipe()
+		c.removeCgroup()
+		return pid, newStartError(cmdl, err)
+	}
+
+	c.pid = c.cmd.Process.Pid
+	c.initPipe = initPipe
+	c.trace = trace
+	c.startCapture()
+	c.startExpect()
+	c.startCombined()
+	c.startStdin()
 	c.wg.Add(1)
-	go c.handleReader(c.stderr, STDERR)
-	go c.checkProcStateIsRunning()
+	go c.handleReader(c.stdoutbuf, c.stdoutLine, c.stdoutTee)
+	if c.stderr != nil {
+		c.wg.Add(1)
+		go c.handleReader(c.stderrbuf, c.stderrLine, c.stderrTee)
+	}
+	c.waitDone = make(chan struct{})
+	go func(cmd *exec.Cmd, done chan struct{}) {
+		trace.wait()
+		c.wait(cmd, done)
+	}(c.cmd, c.waitDone)
+	go c.watchContext(c.ctx, c.waitDone)
+	c.exited = make(chan struct{})
+	go watchExit(c.pidfd, c.waitDone, c.exited)
 	return c.pid, nil
 }
 
+// Pause stops the running subprocess with SIGTSTP until Resume.
 func (c *Cmd) Pause() error {
-	// pause subprocess
-	return c.cmd.Process.Signal(syscall.SIGTSTP)
+	return c.sendSignal(c.cmd.Process, syscall.SIGTSTP)
 }
 
 func (c *Cmd) GetOutput() ([]byte, error) {
@@ -436,6 +630,10 @@ func (c *Cmd) GetStderrOutput() ([]byte, error) {
 	return c.stderrbuf.Bytes(), nil
 }
 
+// NeedInput prints text and forwards a line read from os.Stdin to the
+// subprocess.
+//
+// Deprecated: use Expect and SendLine.
 func (c *Cmd) NeedInput(text string) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -453,59 +651,6 @@ func (c *Cmd) NeedInput(text string) {
 	}
 }
 
-func (c *Cmd) handleReader(std io.ReadCloser, stdio int) {
-	defer func() {
-		c.wg.Done()
-	}()
-
-	for {
-		var err error
-		var str string
-		if stdio == STDOUT {
-			str, err = c.stdoutbuf.Read()
-		} else if stdio == STDERR {
-			str, err = c.stderrbuf.Read()
-		}
-		if err != nil {
-			if errors.Is(err, io.ErrClosedPipe) {
-				if c.debug {
-					log.Info(err)
-				}
-				return
-			} else if errors.Is(err, os.ErrClosed) {
-				if c.debug {
-					log.Info(err)
-				}
-				return
-			} else if errors.Is(err, os.ErrDeadlineExceeded) {
-				if c.debug {
-					log.Info(err)
-				}
-				return
-			} else if errors.Is(err, io.ErrUnexpectedEOF) {
-				if c.debug {
-					log.Info(err)
-				}
-				return
-			} else if errors.Is(err, io.EOF) {
-				if c.debug {
-					log.Info("Read EOF")
-				}
-				return
-			} else {
-				if c.debug {
-					log.Error(err)
-				}
-				break
-			}
-		}
-
-		if c.debug {
-			log.Infof("%s", str)
-		}
-	}
-}
-
 func (c *Cmd) CheckRoot() error {
 	user, err := user.Current()
 	if err != nil {
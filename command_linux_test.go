@@ -1,85 +1,347 @@
 package utils
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"os/exec"
 	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
-func TestCmd(t *testing.T) {
-	cmd := NewCmd()
-	// user, err := user.Current()
-	// if err != nil {
-	// 	log.Println(err)
-	// 	return
-	// }
-	// cmd.SetUser(user)
+func TestV2(t *testing.T) {
+	cmd := NewCmd().SetDebug(true)
 	defer cmd.Close()
-	// path, err := os.Getwd()
-	// if err != nil {
-	// 	log.Println(err)
-	// 	return
-	// }
-	// cmd.SetTimeout(1 * time.Second)
-	args := []string{"--cpu", "1", "--vm", "1", "--vm-bytes", "220M", "--timeout", "10s", "--vm-keep"}
-	pid, err := cmd.Command("stress", args...)
+	args := []string{"-c", "$(echo -1000 > /proc/" + strconv.Itoa(os.Getpid()) + "/oom_score_adj)"}
+	_, err := cmd.RunCommand("/bin/bash", args...)
 	if err != nil {
-		log.Println(err)
-		return
+		fmt.Printf("%s\n", err.Error())
+	} else {
+		fmt.Println("done")
 	}
-	// cmd.NeedInput("hello:")
-	pid1 := cmd.GetPid()
-	log.Printf("pid is: %d, %d", pid, pid1)
-	out, err := cmd.Run()
+}
+
+func TestCmdOnLine(t *testing.T) {
+	var stdout, stderr []string
+	var tee bytes.Buffer
+	cmd := NewCmd().
+		OnStdoutLine(func(line string) { stdout = append(stdout, line) }).
+		OnStderrLine(func(line string) { stderr = append(stderr, line) }).
+		SetStdoutWriter(&tee)
+	defer cmd.Close()
+	out, err := cmd.RunCommand("/bin/sh", "-c", "echo one; echo two >&2; echo three")
 	if err != nil {
-		log.Println(err.Error())
-		return
+		t.Fatal(err)
+	}
+	if strings.Join(stdout, ",") != "one,three" {
+		t.Fatalf("stdout lines: %q", stdout)
+	}
+	if strings.Join(stderr, ",") != "two" {
+		t.Fatalf("stderr lines: %q", stderr)
+	}
+	if tee.String() != string(out) {
+		t.Fatalf("tee %q != output %q", tee.String(), out)
 	}
-	log.Printf("%s", out)
 }
 
-func TestCmd2(t *testing.T) {
-	cmd := NewCmd().SetDebug(true)
-	// user, err := user.Current()
-	// if err != nil {
-	// 	log.Println(err)
-	// 	return
-	// }
-	// cmd.SetUser(user)
+func TestCmdBinaryOutput(t *testing.T) {
+	var lines []string
+	cmd := NewCmd().OnStdoutLine(func(line string) { lines = append(lines, line) })
 	defer cmd.Close()
-	// path, err := os.Getwd()
-	// if err != nil {
-	// 	log.Println(err)
-	// 	return
-	// }
-	// cmd.SetTimeout(1 * time.Second)
-	args := []string{"/home/realjf/Downloads/e780530a-5eac-4118-9aa0-cb2d2f3e7db8.epub", "/home/realjf/Downloads/e780530a-5eac-4118-9aa0-cb2d2f3e7db8.pdf"}
-	pid, err := cmd.Command("ebook-convert", args...)
+	out, err := cmd.RunCommand("/bin/sh", "-c", `printf '\000\001\377\nlast'; head -c 3000000 /dev/zero | tr '\000' x`)
 	if err != nil {
-		log.Println(err)
-		return
+		t.Fatal(err)
 	}
-	// cmd.NeedInput("hello:")
-	pid1 := cmd.GetPid()
-	log.Printf("pid is: %d, %d", pid, pid1)
-	out, err := cmd.Run()
+	want := "\x00\x01\xff\nlast" + strings.Repeat("x", 3000000)
+	if string(out) != want {
+		t.Fatalf("got %d bytes, want %d", len(out), len(want))
+	}
+	if len(lines) < 2 || lines[0] != "\x00\x01\xff" || strings.Join(lines[1:], "") != want[4:] {
+		t.Fatalf("unexpected lines, first %q", lines[0])
+	}
+}
+
+func TestCmdCaptureLimit(t *testing.T) {
+	cmd := NewCmd().
+		SetCaptureLimit(STDOUT, CaptureLimit{Size: 1000, Policy: CaptureTail}).
+		SetCaptureLimit(STDERR, CaptureLimit{Size: 10})
+	defer cmd.Close()
+	res, err := cmd.RunCommandResult("/bin/sh", "-c", `seq 100000; seq 1000 >&2`)
 	if err != nil {
-		log.Println(err.Error())
-		return
+		t.Fatal(err)
+	}
+	if len(res.Stdout) != 1000 || !strings.HasSuffix(string(res.Stdout), "\n99999\n100000\n") {
+		t.Fatalf("unexpected stdout tail %q", res.Stdout)
+	}
+	if string(res.Stderr) != "1\n2\n3\n4\n5\n" || res.StderrDropped != 3893-10 {
+		t.Fatalf("unexpected stderr %q, dropped %d", res.Stderr, res.StderrDropped)
+	}
+	if res.StdoutDropped != 588895-1000 || res.StdoutSpill != "" || res.SpillErr != nil {
+		t.Fatalf("unexpected stdout drop %d %q %v", res.StdoutDropped, res.StdoutSpill, res.SpillErr)
 	}
-	log.Printf("%s", out)
 }
 
-func TestV2(t *testing.T) {
-	cmd := NewCmd().SetDebug(true)
+func TestCmdRunResult(t *testing.T) {
+	cmd := NewCmd()
 	defer cmd.Close()
-	args := []string{"-c", "$(echo -1000 > /proc/" + strconv.Itoa(os.Getpid()) + "/oom_score_adj)"}
-	_, err := cmd.RunCommand("/bin/bash", args...)
+	res, err := cmd.RunCommandResult("/bin/sh", "-c", "echo out; echo err >&2; exit 3")
+	if err == nil {
+		t.Fatal("expected exit error")
+	}
+	if res.ExitCode != 3 || res.Signaled || res.TimedOut {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if string(res.Stdout) != "out\n" || string(res.Stderr) != "err\n" {
+		t.Fatalf("stdout %q stderr %q", res.Stdout, res.Stderr)
+	}
+	if res.Pid == 0 || res.Duration <= 0 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	cmd = NewCmd().SetTimeout(200 * time.Millisecond)
+	defer cmd.Close()
+	res, err = cmd.RunCommandResult("sleep", "5")
+	if err == nil {
+		t.Fatal("expected timeout")
+	}
+	if !res.TimedOut || !res.Signaled || res.Signal != syscall.SIGTERM || res.StopStep != StopSignal {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
+
+func TestCmdErrors(t *testing.T) {
+	cmd := NewCmd()
+	defer cmd.Close()
+	_, err := cmd.RunCommand("/bin/sh", "-c", "echo failed >&2; exit 2")
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 2 || string(exitErr.Stderr) != "failed\n" {
+		t.Fatalf("expected ExitError, got %#v", err)
+	}
+	var execErr *exec.ExitError
+	if !errors.As(err, &execErr) {
+		t.Fatalf("ExitError does not wrap *exec.ExitError: %v", err)
+	}
+
+	_, err = NewCmd().RunCommand("/nonexistent/command")
+	var startErr *StartError
+	if !errors.As(err, &startErr) {
+		t.Fatalf("expected StartError, got %#v", err)
+	}
+
+	_, err = NewCmd().SetTimeout(100*time.Millisecond).RunCommand("sleep", "5")
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected TimeoutError, got %#v", err)
+	}
+
+	_, err = NewCmd().RunCommand("/bin/sh", "-c", "kill -TERM $$")
+	var sigErr *SignaledError
+	if !errors.As(err, &sigErr) || sigErr.Signal != syscall.SIGTERM {
+		t.Fatalf("expected SignaledError, got %#v", err)
+	}
+}
+
+func TestCmdRunContext(t *testing.T) {
+	cmd := NewCmd().SetStopPolicy(StopPolicy{Grace: 100 * time.Millisecond})
+	defer cmd.Close()
+	if _, err := cmd.CommandContext(context.Background(), "/bin/sh", "-c", "sleep 10 & sleep 10"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	res, err := cmd.RunResultContext(ctx)
+	var canceledErr *CanceledError
+	if !errors.As(err, &canceledErr) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected CanceledError, got %#v", err)
+	}
+	if !res.Canceled || res.TimedOut {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	cmd = NewCmd().SetTimeout(time.Minute)
+	defer cmd.Close()
+	if _, err = cmd.CommandContext(ctx, "sleep", "10"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = cmd.Run()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %#v", err)
+	}
+}
+
+func TestCmdStopPolicy(t *testing.T) {
+	cmd := NewCmd().
+		SetTimeout(200 * time.Millisecond).
+		SetStopPolicy(StopPolicy{Signal: syscall.SIGINT, Grace: 300 * time.Millisecond})
+	defer cmd.Close()
+	res, err := cmd.RunCommandResult("/bin/sh", "-c", "trap '' INT; sleep 5")
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Step != StopKill {
+		t.Fatalf("expected TimeoutError stopped by kill, got %#v", err)
+	}
+	if res.Signal != syscall.SIGKILL || res.StopStep != StopKill {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	cmd = NewCmd()
+	defer cmd.Close()
+	if _, err = cmd.Command("sleep", "5"); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := cmd.Stop(context.Background()); err != nil {
+			t.Error(err)
+		}
+	}()
+	res, err = cmd.RunResult()
+	if !errors.Is(err, context.Canceled) || res.StopStep != StopSignal || res.Signal != syscall.SIGTERM {
+		t.Fatalf("unexpected result: %+v, %v", res, err)
+	}
+}
+
+func TestCmdKillTree(t *testing.T) {
+	cmd := NewCmd().SetProcessGroup(NewProcessGroup).SetTimeout(200 * time.Millisecond)
+	defer cmd.Close()
+	start := time.Now()
+	_, err := cmd.RunCommand("/bin/sh", "-c", "sleep 30 & sleep 30")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if time.Since(start) > readerStopDelay {
+		t.Fatalf("grandchild kept the pipes open for %s", time.Since(start))
+	}
+
+	// the grandchild escapes into its own session, only the /proc walk finds it
+	cmd = NewCmd().OnStdoutLine(func(line string) {})
+	defer cmd.Close()
+	if _, err = cmd.Command("/bin/sh", "-c", "setsid sleep 30 & echo $!; wait"); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		if err := cmd.KillTree(); err != nil {
+			t.Error(err)
+		}
+	}()
+	res, err := cmd.RunResult()
+	var sigErr *SignaledError
+	if !errors.As(err, &sigErr) || res.StopStep != StopKill {
+		t.Fatalf("expected SignaledError, got %#v", err)
+	}
+	escaped, err := strconv.Atoi(strings.TrimSpace(string(res.Stdout)))
 	if err != nil {
-		fmt.Printf("%s\n", err.Error())
-	} else {
-		fmt.Println("done")
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(escaped) + "/stat")
+	if err == nil && !strings.Contains(string(stat), ") Z ") {
+		t.Fatalf("escaped descendant is still running: %s", stat)
+	}
+}
+
+func TestCmdStartBarrier(t *testing.T) {
+	marker := t.TempDir() + "/started"
+	// rlimits go through the trampoline, which holds the command before exec
+	cmd := NewCmd().SetRlimit(syscall.RLIMIT_NOFILE, 64, 64)
+	defer cmd.Close()
+	pid, err := cmd.Command("/bin/sh", "-c", "touch "+marker+"; echo ran")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Fatalf("command ran before Run: %v", err)
+	}
+	exe, _ := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe")
+	self, _ := os.Executable()
+	if exe != self {
+		t.Fatalf("held subprocess runs %s", exe)
+	}
+	out, err := cmd.Run()
+	if err != nil || string(out) != "ran\n" {
+		t.Fatalf("unexpected output %q %v", out, err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatal(err)
+	}
+
+	// a held subprocess exits on Close without running
+	cmd2 := NewCmd().SetRlimit(syscall.RLIMIT_NOFILE, 64, 64)
+	pid, err = cmd2.Command("/bin/sh", "-c", "touch "+marker+"2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd2.Close()
+	if _, err := cmd2.Run(); err == nil {
+		t.Fatal("expected an error for a subprocess closed before Run")
+	}
+	if _, err := os.Stat(marker + "2"); !os.IsNotExist(err) {
+		t.Fatalf("closed command ran: %v", err)
+	}
+
+	// without, it is held traced at exec
+	cmd4 := NewCmd()
+	if pid, err = cmd4.Command("/bin/sh", "-c", "touch "+marker+"3"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if stopped, err := CheckProcStateIsStopped(pid); err != nil || !stopped {
+		t.Fatalf("held subprocess not stopped: %v", err)
+	}
+	cmd4.Close()
+	if _, err := os.Stat(marker + "3"); !os.IsNotExist(err) {
+		t.Fatalf("closed command ran: %v", err)
+	}
+
+	// stopped while held, it gets the signal before it runs
+	cmd5 := NewCmd()
+	defer cmd5.Close()
+	if _, err = cmd5.Command("/bin/sh", "-c", "touch "+marker+"4"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := cmd5.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker + "4"); !os.IsNotExist(err) {
+		t.Fatalf("stopped command ran: %v", err)
+	}
+
+	cmd3 := NewCmd()
+	defer cmd3.Close()
+	if pid, err = cmd3.Command("sleep", "5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd3.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd3.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	var stopped bool
+	for i := 0; i < 50 && !stopped; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if stopped, err = CheckProcStateIsStopped(pid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !stopped {
+		t.Fatal("subprocess not stopped by Pause")
+	}
+	if err := cmd3.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if stopped, err = CheckProcStateIsStopped(pid); err != nil || stopped {
+		t.Fatalf("subprocess still stopped after Resume: %v", err)
 	}
+	cmd3.Stop(context.Background())
 }
@@ -18,28 +18,48 @@ import (
 )
 
 type Cmd struct {
-	user      *UserAccount
-	debug     bool
-	stdoutbuf *IOReadCloser
-	stderrbuf *IOReadCloser
-	wg        sync.WaitGroup
-	pid       int
-	cmd       *exec.Cmd
-	timeout   time.Duration
-	workDir   string
-	ctx       context.Context
-	cancel    context.CancelFunc
-	procAttr  *syscall.SysProcAttr
+	user         *UserAccount
+	debug        bool
+	stdoutbuf    *IOReadCloser
+	stderrbuf    *IOReadCloser
+	wg           sync.WaitGroup
+	pid          int
+	cmd          *exec.Cmd
+	timeout      time.Duration
+	workDir      string
+	ctx          context.Context
+	cancel       context.CancelFunc
+	ctxErr       error
+	stopPolicy   StopPolicy
+	stopStep     StopStep
+	waitDone     chan struct{}
+	waitErr      error
+	exitTime     time.Time
+	processGroup ProcessGroup
+	procAttr     *syscall.SysProcAttr
 	// credential  *syscall.Credential
 	stdout      io.ReadCloser
 	stderr      io.ReadCloser
 	stdin       io.WriteCloser
-	stdinChan   chan string
-	running     bool
+	expect      *expectBuffer
+	expectOn    bool
+	autoAnswers []autoAnswer
+	transcript  bool
+	combined    bool
+	combinedOut *combinedOutput
+	stdoutLimit CaptureLimit
+	stderrLimit CaptureLimit
+	stdinSource io.Reader
+	stdinErr    error
+	stdinDone   chan struct{}
 	lock        sync.RWMutex
 	env         []string
 	noSetGroups bool
 	stop        chan bool
+	stdoutLine  LineHandler
+	stderrLine  LineHandler
+	stdoutTee   io.Writer
+	stderrTee   io.Writer
 	kernel32DLL *syscall.LazyDLL
 }
 
@@ -59,12 +79,14 @@ func NewCmd() *Cmd {
 		stdout:      nil,
 		stderr:      nil,
 		stdin:       nil,
-		stdinChan:   make(chan string),
-		running:     false,
 		lock:        sync.RWMutex{},
 		env:         nil,
 		noSetGroups: false,
 		stop:        make(chan bool),
+		stdoutLine:  nil,
+		stderrLine:  nil,
+		stdoutTee:   nil,
+		stderrTee:   nil,
 		kernel32DLL: syscall.NewLazyDLL("Kernel32.dll"),
 	}
 	runtime.SetFinalizer(c, (*Cmd).Close)
@@ -108,12 +130,14 @@ func NewCommand() *Cmd {
 		stdout:      nil,
 		stderr:      nil,
 		stdin:       nil,
-		stdinChan:   make(chan string),
-		running:     false,
 		lock:        sync.RWMutex{},
 		env:         nil,
 		noSetGroups: false,
 		stop:        make(chan bool),
+		stdoutLine:  nil,
+		stderrLine:  nil,
+		stdoutTee:   nil,
+		stderrTee:   nil,
 		kernel32DLL: syscall.NewLazyDLL("Kernel32.dll"),
 	}
 	runtime.SetFinalizer(c, (*Cmd).Close)
@@ -156,8 +180,16 @@ func (c *Cmd) SetDebug(debug bool) *Cmd {
 }
 
 func (c *Cmd) Mkdir(path string, perm os.FileMode) (output []byte, err error) {
+	res, err := c.MkdirResult(path, perm)
+	if res != nil {
+		output = res.Stdout
+	}
+	return
+}
+
+func (c *Cmd) MkdirResult(path string, perm os.FileMode) (res *Result, err error) {
 	args := []string{"/c", "mkdir", "-p", path, "-m", "=" + perm.String()}
-	output, err = c.RunCommand("cmd", args...)
+	res, err = c.RunCommandResult("cmd", args...)
 	if err != nil {
 		if c.debug {
 			log.Error(err.Error())
@@ -175,50 +207,27 @@ func (c *Cmd) RunCommand(cmdl string, args ...string) (output []byte, err error)
 	return c.Run()
 }
 
+func (c *Cmd) RunCommandResult(cmdl string, args ...string) (*Result, error) {
+	_, err := c.Command(cmdl, args...)
+	if err != nil {
+		return nil, err
+	}
+	return c.RunResult()
+}
+
 func (c *Cmd) GetPid() int {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 	return c.pid
 }
 
+// Resume continues the subprocess after Pause.
 func (c *Cmd) Resume() error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	// resume subprocess
 	return c.cmd.Process.Signal(syscall.SIGCONT)
 }
 
-func (c *Cmd) checkProcStateIsRunning() {
-	for {
-		if c.running {
-			run, err := CheckProcStateIsStopped(c.pid)
-			if err != nil {
-				if c.debug {
-					log.Error(err)
-				}
-
-			}
-			if !run {
-				err = c.Resume()
-				if err != nil {
-					if errors.Is(err, os.ErrProcessDone) {
-						break
-					}
-					if c.debug {
-						log.Error(err)
-					}
-				}
-				c.running = true
-			} else {
-				break
-			}
-		} else {
-			break
-		}
-		time.Sleep(3 * time.Second)
-	}
-}
-
 func (c *Cmd) GetUser() *UserAccount {
 	return c.user
 }
@@ -237,26 +246,40 @@ func (c *Cmd) SetUsername(username string) error {
 }
 
 func (c *Cmd) Run() (output []byte, err error) {
+	return c.RunContext(context.Background())
+}
+
+func (c *Cmd) RunContext(ctx context.Context) (output []byte, err error) {
+	res, err := c.RunResultContext(ctx)
+	if res == nil {
+		return nil, err
+	}
+	return res.Stdout, err
+}
+
+func (c *Cmd) RunResult() (res *Result, err error) {
+	return c.RunResultContext(context.Background())
+}
+
+func (c *Cmd) RunResultContext(ctx context.Context) (res *Result, err error) {
 	if c.cmd.Process == nil {
 		if c.debug {
 			log.Error("subprocess already exited")
 		}
-		return nil, errors.New("subprocess already exited")
+		return nil, ErrSubprocessExited
 	}
-	err = c.Resume()
-	if err != nil {
-		if !errors.Is(err, os.ErrProcessDone) {
-			return nil, err
-		}
+	res = &Result{
+		Pid:       c.GetPid(),
+		StartTime: time.Now(),
 	}
-	c.wg.Wait()
-
-	if err = c.cmd.Wait(); err != nil {
+	err = c.waitContext(ctx)
+	c.finishResult(res)
+	if err != nil {
 		if errors.Is(err, os.ErrProcessDone) {
 			if c.debug {
 				log.Infof("Process done: %s", err.Error())
 			}
-			return c.stdoutbuf.Bytes(), nil
+			return res, nil
 		}
 		if exiterr, ok := err.(*exec.ExitError); ok {
 			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
@@ -264,16 +287,16 @@ func (c *Cmd) Run() (output []byte, err error) {
 					log.Infof("Exit Status: %d", status.ExitStatus())
 				}
 
-				return c.stdoutbuf.Bytes(), err
+				return res, c.waitError(res, err)
 			}
 		}
 		if c.debug {
 			log.Error(err.Error())
 		}
-		return c.stdoutbuf.Bytes(), err
+		return res, c.waitError(res, err)
 	}
 
-	return c.GetOutput()
+	return res, nil
 }
 
 func (c *Cmd) Close() error {
@@ -311,7 +334,12 @@ func (c *Cmd) SetEnv(envs []string) *Cmd {
 // 	return c
 // }
 
+// Command starts the subprocess, it runs right away. Run waits for it.
 func (c *Cmd) Command(cmdl string, args ...string) (pid int, err error) {
+	return c.CommandContext(context.Background(), cmdl, args...)
+}
+
+func (c *Cmd) CommandContext(ctx context.Context, cmdl string, args ...string) (pid int, err error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	if c.debug {
@@ -321,16 +349,25 @@ func (c *Cmd) Command(cmdl string, args ...string) (pid int, err error) {
 	arglist := []string{"/c", cmdl}
 	arglist = append(arglist, args...)
 	if c.timeout > 0 {
-		c.ctx, c.cancel = context.WithTimeout(context.Background(), c.timeout)
-		c.cmd = exec.CommandContext(c.ctx, "cmd", arglist...)
+		c.ctx, c.cancel = context.WithTimeout(ctx, c.timeout)
 	} else {
-		c.cmd = exec.Command("cmd", arglist...)
+		c.ctx, c.cancel = context.WithCancel(ctx)
 	}
+	c.ctxErr = nil
+	c.stopStep = StopNone
+	c.cmd = exec.Command("cmd", arglist...)
 
 	if c.procAttr != nil {
 		c.cmd.SysProcAttr = c.procAttr
 	}
 
+	if c.processGroup != NoProcessGroup {
+		if c.cmd.SysProcAttr == nil {
+			c.cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		c.cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+	}
+
 	// if c.credential != nil {
 	// 	if c.cmd.SysProcAttr == nil {
 	// 		c.cmd.SysProcAttr = &syscall.SysProcAttr{}
@@ -398,37 +435,39 @@ func (c *Cmd) Command(cmdl string, args ...string) (pid int, err error) {
 	}
 	c.stderrbuf = NewReader(c.stderr)
 
-	c.stdin, err = c.cmd.StdinPipe()
+	stdinR, err := c.stdinPipe()
 	if err != nil {
 		if c.debug {
 			log.Error(err.Error())
 		}
 		return pid, err
 	}
+	defer stdinR.Close()
 
 	if err = c.cmd.Start(); err != nil {
 		if c.debug {
 			log.Error(err.Error())
 		}
-		return pid, err
+		return pid, newStartError(cmdl, err)
 	}
 
 	c.pid = c.cmd.Process.Pid
-	err = c.Pause()
-	if err != nil {
-		return pid, err
-	}
-	c.running = false
+	c.startCapture()
+	c.startExpect()
+	c.startCombined()
+	c.startStdin()
 	c.wg.Add(1)
-	go c.handleReader(c.stdout, STDOUT)
+	go c.handleReader(c.stdoutbuf, c.stdoutLine, c.stdoutTee)
 	c.wg.Add(1)
-	go c.handleReader(c.stderr, STDERR)
-	go c.checkProcStateIsRunning()
+	go c.handleReader(c.stderrbuf, c.stderrLine, c.stderrTee)
+	c.waitDone = make(chan struct{})
+	go c.wait(c.cmd, c.waitDone)
+	go c.watchContext(c.ctx, c.waitDone)
 	return c.pid, nil
 }
 
+// Pause stops the running subprocess with SIGTSTP until Resume.
 func (c *Cmd) Pause() error {
-	// pause subprocess
 	return c.cmd.Process.Signal(syscall.SIGTSTP)
 }
 
@@ -444,6 +483,10 @@ func (c *Cmd) GetStderrOutput() ([]byte, error) {
 	return c.stderrbuf.Bytes(), nil
 }
 
+// NeedInput prints text and forwards a line read from os.Stdin to the
+// subprocess.
+//
+// Deprecated: use Expect and SendLine.
 func (c *Cmd) NeedInput(text string) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -461,59 +504,6 @@ func (c *Cmd) NeedInput(text string) {
 	}
 }
 
-func (c *Cmd) handleReader(std io.ReadCloser, stdio int) {
-	defer func() {
-		c.wg.Done()
-	}()
-
-	for {
-		var err error
-		var str string
-		if stdio == STDOUT {
-			str, err = c.stdoutbuf.Read()
-		} else if stdio == STDERR {
-			str, err = c.stderrbuf.Read()
-		}
-		if err != nil {
-			if errors.Is(err, io.ErrClosedPipe) {
-				if c.debug {
-					log.Info(err)
-				}
-				return
-			} else if errors.Is(err, os.ErrClosed) {
-				if c.debug {
-					log.Info(err)
-				}
-				return
-			} else if errors.Is(err, os.ErrDeadlineExceeded) {
-				if c.debug {
-					log.Info(err)
-				}
-				return
-			} else if errors.Is(err, io.ErrUnexpectedEOF) {
-				if c.debug {
-					log.Info(err)
-				}
-				return
-			} else if errors.Is(err, io.EOF) {
-				if c.debug {
-					log.Info("Read EOF")
-				}
-				return
-			} else {
-				if c.debug {
-					log.Error(err)
-				}
-				break
-			}
-		}
-
-		if c.debug {
-			log.Infof("%s", str)
-		}
-	}
-}
-
 func (c *Cmd) CheckRoot() error {
 	user, err := user.Current()
 	if err != nil {
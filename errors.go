@@ -0,0 +1,263 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const stderrTailSize = 1024
+
+var (
+	ErrSubprocessExited = errors.New("subprocess already exited")
+	ErrExpectTimeout    = errors.New("expect timeout")
+	ErrExpectDisabled   = errors.New("expect not enabled, see SetExpect")
+	// ErrInitNotExecutable is returned when the program cannot be
+	// re-executed as the user of the command to apply settings before
+	// exec, e.g. rlimits.
+	ErrInitNotExecutable = errors.New("program not executable by the command user for the init trampoline")
+)
+
+// StartError is returned when the subprocess could not be started.
+type StartError struct {
+	Name string
+	Err  error
+}
+
+func (e *StartError) Error() string {
+	return fmt.Sprintf("start %s: %s", e.Name, e.Err.Error())
+}
+
+func (e *StartError) Unwrap() error {
+	return e.Err
+}
+
+// PermissionError is returned when the subprocess could not be started
+// because of missing privileges, e.g. switching uid/gid without root.
+// Hint suggests a fix.
+type PermissionError struct {
+	Op   string
+	Hint string
+	Err  error
+}
+
+func (e *PermissionError) Error() string {
+	hint := e.Hint
+	if hint == "" {
+		hint = "run as root or call SetNoSetGroups(true)"
+	}
+	return fmt.Sprintf("%s: %s (%s)", e.Op, e.Err.Error(), hint)
+}
+
+func (e *PermissionError) Unwrap() error {
+	return e.Err
+}
+
+// ExitError is returned when the subprocess exited with a non-zero code.
+// Stderr holds the tail of the captured stderr output.
+type ExitError struct {
+	Code   int
+	Stderr []byte
+	Err    error
+}
+
+func (e *ExitError) Error() string {
+	msg := fmt.Sprintf("exit status %d", e.Code)
+	if tail := strings.TrimSpace(string(e.Stderr)); tail != "" {
+		msg += ": " + tail
+	}
+	return msg
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// SignaledError is returned when the subprocess was terminated by a signal.
+type SignaledError struct {
+	Signal syscall.Signal
+	Err    error
+}
+
+func (e *SignaledError) Error() string {
+	return fmt.Sprintf("terminated by signal %s", e.Signal.String())
+}
+
+func (e *SignaledError) Unwrap() error {
+	return e.Err
+}
+
+// LimitError is returned when the subprocess was terminated for exceeding
+// a resource limit, e.g. SIGXCPU for RLIMIT_CPU. It wraps a SignaledError.
+type LimitError struct {
+	Resource string
+	Err      error
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s exceeded: %s", e.Resource, e.Err.Error())
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// TimeoutError is returned when the subprocess was killed because the
+// timeout set with SetTimeout expired. It matches context.DeadlineExceeded.
+type TimeoutError struct {
+	After time.Duration
+	Step  StopStep
+	Err   error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timeout after %s, stopped by %s: %s", e.After.String(), e.Step.String(), e.Err.Error())
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// CanceledError is returned when the subprocess was killed because its
+// context was canceled. It matches context.Canceled.
+type CanceledError struct {
+	Step StopStep
+	Err  error
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("canceled, stopped by %s: %s", e.Step.String(), e.Err.Error())
+}
+
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CanceledError) Is(target error) bool {
+	return target == context.Canceled
+}
+
+// ExpectError is returned by Expect when the output did not match before
+// the timeout (ErrExpectTimeout) or the end of the output (io.EOF). Output
+// holds what was left unmatched.
+type ExpectError struct {
+	Patterns string
+	Output   string
+	Err      error
+}
+
+func (e *ExpectError) Error() string {
+	return fmt.Sprintf("expect %s: %s, unmatched output %q", e.Patterns, e.Err.Error(), e.Output)
+}
+
+func (e *ExpectError) Unwrap() error {
+	return e.Err
+}
+
+// SignalError is returned by ProcessList.Signal when some of the Total
+// processes could not be signalled. Errors maps their pids to the cause.
+type SignalError struct {
+	Signal syscall.Signal
+	Total  int
+	Errors map[int]error
+}
+
+func (e *SignalError) Error() string {
+	pids := make([]int, 0, len(e.Errors))
+	for pid := range e.Errors {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	msgs := make([]string, len(pids))
+	for i, pid := range pids {
+		msgs[i] = fmt.Sprintf("%d: %s", pid, e.Errors[pid].Error())
+	}
+	return fmt.Sprintf("signal %s: %d of %d processes failed: %s", e.Signal.String(), len(pids), e.Total, strings.Join(msgs, ", "))
+}
+
+// GaveUpError is returned by a Supervisor that stopped restarting its
+// command after Restarts restarts within Window. Err is the error of the
+// last run.
+type GaveUpError struct {
+	Restarts int
+	Window   time.Duration
+	Err      error
+}
+
+func (e *GaveUpError) Error() string {
+	msg := fmt.Sprintf("gave up after %d restarts", e.Restarts)
+	if e.Window > 0 {
+		msg += " within " + e.Window.String()
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *GaveUpError) Unwrap() error {
+	return e.Err
+}
+
+func newStartError(name string, err error) error {
+	var permErr *PermissionError
+	if errors.Is(err, os.ErrPermission) && !errors.As(err, &permErr) {
+		err = &PermissionError{Op: "fork/exec " + name, Err: err}
+	}
+	return &StartError{Name: name, Err: err}
+}
+
+func (c *Cmd) waitError(res *Result, err error) error {
+	if err == nil || res == nil {
+		return err
+	}
+	if res.TimedOut {
+		c.lock.RLock()
+		timeout := c.timeout
+		c.lock.RUnlock()
+		if timeout <= 0 {
+			timeout = res.Duration
+		}
+		return &TimeoutError{After: timeout, Step: res.StopStep, Err: err}
+	}
+	if res.Canceled {
+		return &CanceledError{Step: res.StopStep, Err: err}
+	}
+	if _, ok := err.(*exec.ExitError); !ok {
+		return err
+	}
+	if res.Signaled {
+		sigErr := &SignaledError{Signal: res.Signal, Err: err}
+		if res.Limit != "" {
+			return &LimitError{Resource: res.Limit, Err: sigErr}
+		}
+		return sigErr
+	}
+	return &ExitError{Code: res.ExitCode, Stderr: stderrTail(res.Stderr), Err: err}
+}
+
+func stderrTail(stderr []byte) []byte {
+	if len(stderr) <= stderrTailSize {
+		return stderr
+	}
+	tail := stderr[len(stderr)-stderrTailSize:]
+	if i := bytes.IndexByte(tail, '\n'); i >= 0 && i < len(tail)-1 {
+		tail = tail[i+1:]
+	}
+	return tail
+}
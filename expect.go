@@ -0,0 +1,350 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TranscriptKind tells what a transcript entry records.
+type TranscriptKind int
+
+const (
+	TranscriptOutput TranscriptKind = iota
+	TranscriptInput
+	TranscriptMatch
+	TranscriptTimeout
+	TranscriptEOF
+)
+
+func (k TranscriptKind) String() string {
+	switch k {
+	case TranscriptOutput:
+		return "output"
+	case TranscriptInput:
+		return "input"
+	case TranscriptMatch:
+		return "match"
+	case TranscriptTimeout:
+		return "timeout"
+	case TranscriptEOF:
+		return "eof"
+	default:
+		return "unknown"
+	}
+}
+
+// TranscriptEntry is one step of the exchange with the subprocess.
+type TranscriptEntry struct {
+	Time time.Time
+	Kind TranscriptKind
+	Data string
+}
+
+func (e TranscriptEntry) String() string {
+	return fmt.Sprintf("%s %-7s %q", e.Time.Format("15:04:05.000"), e.Kind.String(), e.Data)
+}
+
+// expectWindow is how much unconsumed output Expect searches, older output
+// is dropped.
+const expectWindow = 64 * 1024
+
+type autoAnswer struct {
+	re     *regexp.Regexp
+	answer string
+}
+
+// expectBuffer collects stdout and stderr of a running command as it is
+// read from the pipes, prompts without a trailing newline included. Output
+// up to the end of a match is consumed, so every Expect only sees what came
+// after the previous one.
+type expectBuffer struct {
+	lock       sync.Mutex
+	stdin      io.Writer
+	buf        []byte
+	changed    chan struct{}
+	eof        bool
+	answers    []autoAnswer
+	replies    []string
+	replying   bool
+	record     bool
+	transcript []TranscriptEntry
+	debug      bool
+}
+
+func newExpectBuffer(stdin io.Writer, answers []autoAnswer, record, debug bool) *expectBuffer {
+	return &expectBuffer{
+		stdin:   stdin,
+		changed: make(chan struct{}),
+		answers: append([]autoAnswer(nil), answers...),
+		record:  record,
+		debug:   debug,
+	}
+}
+
+// feed is called by the output readers with every chunk they read.
+func (e *expectBuffer) feed(data []byte) {
+	e.lock.Lock()
+	e.buf = append(e.buf, data...)
+	if len(e.buf) > expectWindow {
+		e.buf = append(e.buf[:0], e.buf[len(e.buf)-expectWindow:]...)
+	}
+	e.log(TranscriptOutput, string(data))
+	for {
+		reply, ok := e.autoAnswer()
+		if !ok {
+			break
+		}
+		e.replies = append(e.replies, reply)
+	}
+	if len(e.replies) > 0 && !e.replying {
+		e.replying = true
+		go e.sendReplies()
+	}
+	e.signal()
+	e.lock.Unlock()
+}
+
+// sendReplies writes the queued automatic answers in order. It does not run
+// on the output readers: a subprocess that does not read its stdin while
+// writing output would block them.
+func (e *expectBuffer) sendReplies() {
+	for {
+		e.lock.Lock()
+		if len(e.replies) == 0 {
+			e.replying = false
+			e.lock.Unlock()
+			return
+		}
+		reply := e.replies[0]
+		e.replies = e.replies[1:]
+		e.lock.Unlock()
+		if err := e.send(reply); err != nil && e.debug {
+			log.Error(err)
+		}
+	}
+}
+
+// autoAnswer consumes the first prompt that has an automatic answer.
+// The caller holds e.lock.
+func (e *expectBuffer) autoAnswer() (string, bool) {
+	for _, a := range e.answers {
+		// an empty match would answer forever
+		if loc := a.re.FindIndex(e.buf); loc != nil && loc[1] > loc[0] {
+			e.log(TranscriptMatch, a.re.String())
+			// only the prompt is consumed, output before it is left to Expect
+			e.buf = append(e.buf[:loc[0]], e.buf[loc[1]:]...)
+			return a.answer, true
+		}
+	}
+	return "", false
+}
+
+// close marks the end of the output once the subprocess has exited.
+func (e *expectBuffer) close() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if !e.eof {
+		e.eof = true
+		e.signal()
+	}
+}
+
+// signal wakes up waiting Expect calls. The caller holds e.lock.
+func (e *expectBuffer) signal() {
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// log adds to the transcript if it is enabled. The caller holds e.lock.
+func (e *expectBuffer) log(kind TranscriptKind, data string) {
+	if !e.record {
+		return
+	}
+	e.transcript = append(e.transcript, TranscriptEntry{Time: time.Now(), Kind: kind, Data: data})
+}
+
+func (e *expectBuffer) send(s string) error {
+	e.lock.Lock()
+	e.log(TranscriptInput, s)
+	e.lock.Unlock()
+	_, err := io.WriteString(e.stdin, s)
+	return err
+}
+
+func (e *expectBuffer) expect(timeout time.Duration, patterns []*regexp.Regexp) (int, []string, error) {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for {
+		e.lock.Lock()
+		for i, re := range patterns {
+			if loc := re.FindSubmatchIndex(e.buf); loc != nil {
+				match := submatches(e.buf, loc)
+				e.log(TranscriptMatch, re.String())
+				e.buf = e.buf[loc[1]:]
+				e.lock.Unlock()
+				return i, match, nil
+			}
+		}
+		if e.eof {
+			e.log(TranscriptEOF, patternList(patterns))
+			err := &ExpectError{Patterns: patternList(patterns), Output: string(e.buf), Err: io.EOF}
+			e.lock.Unlock()
+			return -1, nil, err
+		}
+		changed := e.changed
+		e.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			e.lock.Lock()
+			e.log(TranscriptTimeout, patternList(patterns))
+			err := &ExpectError{Patterns: patternList(patterns), Output: string(e.buf), Err: ErrExpectTimeout}
+			e.lock.Unlock()
+			return -1, nil, err
+		}
+	}
+}
+
+func submatches(buf []byte, loc []int) []string {
+	match := make([]string, len(loc)/2)
+	for i := range match {
+		if loc[2*i] >= 0 {
+			match[i] = string(buf[loc[2*i]:loc[2*i+1]])
+		}
+	}
+	return match
+}
+
+func patternList(patterns []*regexp.Regexp) string {
+	list := make([]string, len(patterns))
+	for i, re := range patterns {
+		list[i] = re.String()
+	}
+	return strings.Join(list, " | ")
+}
+
+// startExpect hooks a fresh expect buffer into the output readers before
+// they are started, if Expect, automatic answers or the transcript are
+// enabled. The caller holds c.lock.
+func (c *Cmd) startExpect() {
+	c.expect = nil
+	if !c.expectEnabled() {
+		return
+	}
+	c.expect = newExpectBuffer(c.stdin, c.autoAnswers, c.transcript, c.debug)
+	c.stdoutbuf.addObserver(c.expect.feed)
+	c.stderrbuf.addObserver(c.expect.feed)
+}
+
+func (c *Cmd) expectBuffer() (*expectBuffer, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.expect == nil {
+		if !c.expectEnabled() {
+			return nil, ErrExpectDisabled
+		}
+		return nil, ErrSubprocessExited
+	}
+	return c.expect, nil
+}
+
+// expectEnabled reports whether commands get an expect buffer. The caller
+// holds c.lock.
+func (c *Cmd) expectEnabled() bool {
+	return c.expectOn || len(c.autoAnswers) > 0 || c.transcript
+}
+
+// SetExpect keeps the output of the next commands for Expect, ExpectAny,
+// Send and SendLine. AutoAnswer and SetTranscript enable it too.
+func (c *Cmd) SetExpect(enabled bool) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.expectOn = enabled
+	return c
+}
+
+// Expect waits until the output of the running command, stdout and stderr
+// combined, matches re and returns the match and its submatches. Output up
+// to the end of the match is consumed. A timeout of zero waits until the
+// command exits. On failure an *ExpectError is returned. The output is
+// only kept when SetExpect was called before Command. Command holds the
+// subprocess before exec, call Resume before the first Expect.
+func (c *Cmd) Expect(re *regexp.Regexp, timeout time.Duration) ([]string, error) {
+	_, match, err := c.ExpectAny(timeout, re)
+	return match, err
+}
+
+// ExpectAny waits until the output matches one of patterns and returns its
+// index and submatches. When several match, the first pattern wins.
+func (c *Cmd) ExpectAny(timeout time.Duration, patterns ...*regexp.Regexp) (int, []string, error) {
+	e, err := c.expectBuffer()
+	if err != nil {
+		return -1, nil, err
+	}
+	return e.expect(timeout, patterns)
+}
+
+// Send writes s to the stdin of the running command.
+func (c *Cmd) Send(s string) error {
+	e, err := c.expectBuffer()
+	if err != nil {
+		return err
+	}
+	return e.send(s)
+}
+
+// SendLine writes s and a newline to the stdin of the running command.
+func (c *Cmd) SendLine(s string) error {
+	return c.Send(s + "\n")
+}
+
+// AutoAnswer sends answer whenever the output matches prompt, e.g. to
+// confirm "Continue? [y/N]" prompts. The answer is sent as is, include a
+// newline if the command reads lines. Automatic answers are checked before
+// Expect sees the output and the matched prompt is removed from it. The
+// first one added while a command without expect buffer runs only applies
+// to the next command.
+func (c *Cmd) AutoAnswer(prompt *regexp.Regexp, answer string) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	a := autoAnswer{re: prompt, answer: answer}
+	c.autoAnswers = append(c.autoAnswers, a)
+	if c.expect != nil {
+		c.expect.lock.Lock()
+		c.expect.answers = append(c.expect.answers, a)
+		c.expect.lock.Unlock()
+	}
+	return c
+}
+
+// SetTranscript records the exchange with the subprocess for
+// GetTranscript, for debugging scripted interactions.
+func (c *Cmd) SetTranscript(enabled bool) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.transcript = enabled
+	return c
+}
+
+// GetTranscript returns the exchange with the current or last command:
+// output as it was read, input sent and the outcome of every Expect.
+func (c *Cmd) GetTranscript() []TranscriptEntry {
+	e, err := c.expectBuffer()
+	if err != nil {
+		return nil
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]TranscriptEntry(nil), e.transcript...)
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCmdExpect(t *testing.T) {
+	script := `printf 'Name: '; read name; echo "hello $name"
+printf 'Continue? [y/N] '; read ans; echo "ans=$ans"
+printf 'Pick a or b: '; read pick; echo "picked $pick"`
+	cmd := NewCmd().SetTranscript(true).AutoAnswer(regexp.MustCompile(`Continue\? \[y/N\] `), "y\n")
+	defer cmd.Close()
+	if _, err := cmd.Command("/bin/sh", "-c", script); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Resume(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := cmd.Expect(regexp.MustCompile(`never`), 50*time.Millisecond)
+	if !errors.Is(err, ErrExpectTimeout) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if _, err := cmd.Expect(regexp.MustCompile(`Name: $`), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.SendLine("bob"); err != nil {
+		t.Fatal(err)
+	}
+	match, err := cmd.Expect(regexp.MustCompile(`hello (\w+)`), time.Second)
+	if err != nil || match[1] != "bob" {
+		t.Fatalf("Expect: %q %v", match, err)
+	}
+	i, _, err := cmd.ExpectAny(time.Second, regexp.MustCompile(`ans=n`), regexp.MustCompile(`ans=y`))
+	if err != nil || i != 1 {
+		t.Fatalf("ExpectAny: %d %v", i, err)
+	}
+	if _, err := cmd.Expect(regexp.MustCompile(`Pick a or b: `), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.SendLine("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cmd.Expect(regexp.MustCompile(`picked b`), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cmd.Expect(regexp.MustCompile(`never`), 0); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	out, err := cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "picked b") {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	var inputs []string
+	for _, e := range cmd.GetTranscript() {
+		if e.Kind == TranscriptInput {
+			inputs = append(inputs, e.Data)
+		}
+	}
+	if strings.Join(inputs, "") != "bob\ny\nb\n" {
+		t.Fatalf("unexpected transcript inputs %q", inputs)
+	}
+}
+
+func TestCmdAutoAnswerNotRead(t *testing.T) {
+	// the answer fills the stdin pipe until the prompt's output was read
+	answer := strings.Repeat("y", 256*1024) + "\n"
+	script := `printf 'Go? '; head -c 1048576 /dev/zero; read ans; echo "got ${#ans}"`
+	cmd := NewCmd().AutoAnswer(regexp.MustCompile(`Go\? `), answer)
+	defer cmd.Close()
+	if _, err := cmd.Command("/bin/sh", "-c", script); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cmd.Expect(regexp.MustCompile(`got 262144`), 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCmdExpectDisabled(t *testing.T) {
+	cmd := NewCmd()
+	defer cmd.Close()
+	if _, err := cmd.Command("/bin/sh", "-c", "echo hi"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cmd.Expect(regexp.MustCompile(`hi`), time.Second); !errors.Is(err, ErrExpectDisabled) {
+		t.Fatalf("expected ErrExpectDisabled, got %v", err)
+	}
+	if _, err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
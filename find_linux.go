@@ -0,0 +1,245 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// tcpListen is the TCP_LISTEN state in /proc/net/tcp.
+const tcpListen = "0A"
+
+// ProcessFilter selects processes in FindProcesses, like the options of
+// pgrep. Zero fields match every process.
+type ProcessFilter struct {
+	// Name is matched exactly against the comm and the base names of the
+	// executable and of the first argument.
+	Name string
+	// Cmdline is matched against the arguments joined by spaces.
+	Cmdline *regexp.Regexp
+	// User is matched against the effective uid.
+	User *UserAccount
+	PPid int
+	// MinAge and MaxAge bound the time since the process was started.
+	MinAge time.Duration
+	MaxAge time.Duration
+}
+
+// ProcessList is the result of FindProcesses and FindListeners, sorted by
+// pid.
+type ProcessList []*ProcessInfo
+
+// FindProcesses scans /proc for the processes matching filter. The calling
+// process is never part of the result.
+func FindProcesses(filter ProcessFilter) (ProcessList, error) {
+	pids, err := listPids()
+	if err != nil {
+		return nil, err
+	}
+	self := os.Getpid()
+	now := time.Now()
+	var list ProcessList
+	for _, pid := range pids {
+		if pid == self {
+			continue
+		}
+		info, err := readProcessSummary(pid)
+		if err != nil {
+			if processGone(err) {
+				continue
+			}
+			return nil, err
+		}
+		if !filter.match(info, now) {
+			continue
+		}
+		if err := info.readDetails(); err != nil {
+			return nil, err
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
+
+func (f *ProcessFilter) match(info *ProcessInfo, now time.Time) bool {
+	if f.Name != "" && !info.hasName(f.Name) {
+		return false
+	}
+	if f.Cmdline != nil && !f.Cmdline.MatchString(strings.Join(info.Cmdline, " ")) {
+		return false
+	}
+	if f.User != nil && (len(info.Uids) < 2 || info.Uids[1] != f.User.GetUid()) {
+		return false
+	}
+	if f.PPid != 0 && info.PPid != f.PPid {
+		return false
+	}
+	age := now.Sub(info.StartTime)
+	if f.MinAge > 0 && age < f.MinAge {
+		return false
+	}
+	if f.MaxAge > 0 && age > f.MaxAge {
+		return false
+	}
+	return true
+}
+
+func (info *ProcessInfo) hasName(name string) bool {
+	if info.Comm == name {
+		return true
+	}
+	if info.Exe != "" && filepath.Base(info.Exe) == name {
+		return true
+	}
+	return len(info.Cmdline) > 0 && filepath.Base(info.Cmdline[0]) == name
+}
+
+// FindListeners returns the processes with a TCP socket listening on port,
+// over IPv4 or IPv6, in the network namespace of the caller. Sockets of
+// processes of other users are only found with enough privileges.
+func FindListeners(port int) (ProcessList, error) {
+	inodes := make(map[string]bool)
+	for _, name := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		if err := readListenInodes(name, port, inodes); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// no IPv6
+				continue
+			}
+			return nil, err
+		}
+	}
+	if len(inodes) == 0 {
+		return nil, nil
+	}
+
+	pids, err := listPids()
+	if err != nil {
+		return nil, err
+	}
+	var list ProcessList
+	for _, pid := range pids {
+		if !hasSocket(pid, inodes) {
+			continue
+		}
+		info, err := ReadProcessInfo(pid)
+		if err != nil {
+			if processGone(err) {
+				continue
+			}
+			return nil, err
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
+
+// readListenInodes adds the inodes of the listening sockets on port in the
+// table name to inodes. The local address is hex ip:port.
+func readListenInodes(name string, port int, inodes map[string]bool) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	// header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != tcpListen {
+			continue
+		}
+		i := strings.LastIndexByte(fields[1], ':')
+		if i < 0 {
+			continue
+		}
+		p, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+		if err != nil || int(p) != port {
+			continue
+		}
+		inodes["socket:["+fields[9]+"]"] = true
+	}
+	return scanner.Err()
+}
+
+// hasSocket reports whether pid has one of the sockets open.
+func hasSocket(pid int, sockets map[string]bool) bool {
+	dir := procDir(pid) + "/fd/"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if target, err := os.Readlink(dir + entry.Name()); err == nil && sockets[target] {
+			return true
+		}
+	}
+	return false
+}
+
+// listPids returns the pids in /proc in numerical order.
+func listPids() ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	pids := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		if pid, err := strconv.Atoi(entry.Name()); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// processGone reports whether err is from reading /proc of a process that
+// exited during the scan.
+func processGone(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ESRCH)
+}
+
+// Pids returns the pids in the list.
+func (l ProcessList) Pids() []int {
+	pids := make([]int, len(l))
+	for i, info := range l {
+		pids[i] = info.Pid
+	}
+	return pids
+}
+
+// Signal sends sig to every process in the list, like pkill. Processes
+// that exited since they were found are skipped, also when their pid was
+// given to another process meanwhile. The processes that could not be
+// signalled are reported in a SignalError.
+func (l ProcessList) Signal(sig syscall.Signal) error {
+	failed := make(map[int]error)
+	for _, info := range l {
+		if err := info.signal(sig); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			failed[info.Pid] = err
+		}
+	}
+	if len(failed) > 0 {
+		return &SignalError{Signal: sig, Total: len(l), Errors: failed}
+	}
+	return nil
+}
+
+func (info *ProcessInfo) signal(sig syscall.Signal) error {
+	p, err := OpenProcess(info.Pid)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	if !p.started.Equal(info.StartTime) {
+		return os.ErrProcessDone
+	}
+	return p.Signal(sig)
+}
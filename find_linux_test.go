@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFindProcesses(t *testing.T) {
+	cmd := exec.Command("sleep", "7.123")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	user := NewUserAccount()
+	user.SetUid(uint64(os.Geteuid()))
+	filter := ProcessFilter{
+		Name:    "sleep",
+		Cmdline: regexp.MustCompile(`^sleep 7\.123$`),
+		User:    user,
+		PPid:    os.Getpid(),
+		MaxAge:  time.Minute,
+	}
+	var list ProcessList
+	var err error
+	// the child may not have exec'd yet
+	for i := 0; i < 100 && len(list) == 0; i++ {
+		if list, err = FindProcesses(filter); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(list) != 1 || list[0].Pid != cmd.Process.Pid || list[0].Limits == nil {
+		t.Fatalf("expected pid %d, found %v", cmd.Process.Pid, list.Pids())
+	}
+
+	filter.MinAge = time.Hour
+	if old, err := FindProcesses(filter); err != nil || len(old) != 0 {
+		t.Fatalf("expected no process, found %v %v", old.Pids(), err)
+	}
+
+	if err := list.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Wait()
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); !ok || status.Signal() != syscall.SIGTERM {
+		t.Fatalf("not terminated by SIGTERM: %v", err)
+	}
+	// gone, skipped
+	if err := list.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	sigErr := &SignalError{Signal: syscall.SIGKILL, Total: 3, Errors: map[int]error{7: os.ErrPermission, 3: os.ErrPermission}}
+	if msg := sigErr.Error(); msg != "signal killed: 2 of 3 processes failed: 3: permission denied, 7: permission denied" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+}
+
+func TestFindListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	list, err := FindListeners(l.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Pid != os.Getpid() {
+		t.Fatalf("expected pid %d, found %v", os.Getpid(), list.Pids())
+	}
+
+	if l6, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		defer l6.Close()
+		list, err = FindListeners(l6.Addr().(*net.TCPAddr).Port)
+		if err != nil || len(list) != 1 || list[0].Pid != os.Getpid() {
+			t.Fatalf("expected pid %d over IPv6, found %v %v", os.Getpid(), list.Pids(), err)
+		}
+	}
+
+	// connected, not listening
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if list, err = FindListeners(conn.LocalAddr().(*net.TCPAddr).Port); err != nil || len(list) != 0 {
+		t.Fatalf("expected no listener, found %v %v", list.Pids(), err)
+	}
+}
@@ -0,0 +1,35 @@
+package utils
+
+import "syscall"
+
+// ProcessGroup selects whether a command gets its own process group or
+// session, so that stopping it also reaches the processes it spawned.
+type ProcessGroup int
+
+const (
+	NoProcessGroup ProcessGroup = iota
+	NewProcessGroup
+	NewSession
+)
+
+func (c *Cmd) SetProcessGroup(group ProcessGroup) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.processGroup = group
+	return c
+}
+
+// KillTree sends SIGKILL to the subprocess and everything it spawned.
+func (c *Cmd) KillTree() error {
+	c.lock.Lock()
+	proc := c.cmd.Process
+	if proc == nil {
+		c.lock.Unlock()
+		return ErrSubprocessExited
+	}
+	if c.stopStep == StopNone {
+		c.stopStep = StopKill
+	}
+	c.lock.Unlock()
+	return c.signalTree(proc, syscall.SIGKILL, true)
+}
@@ -0,0 +1,18 @@
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// signalTree sends sig to the subprocess, or to its whole process group
+// when the command runs in its own group or session.
+func (c *Cmd) signalTree(proc *os.Process, sig syscall.Signal, all bool) error {
+	c.lock.RLock()
+	group := c.processGroup
+	c.lock.RUnlock()
+	if group == NoProcessGroup {
+		return proc.Signal(sig)
+	}
+	return syscall.Kill(-proc.Pid, sig)
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// signalTree sends sig to the subprocess. When the command runs in its own
+// process group or session, or when all is set, the whole group and every
+// descendant found under /proc (including ones that escaped into another
+// group) are signalled as well.
+func (c *Cmd) signalTree(proc *os.Process, sig syscall.Signal, all bool) error {
+	c.lock.RLock()
+	group := c.processGroup
+	c.lock.RUnlock()
+	if group == NoProcessGroup && !all {
+		return c.sendSignal(proc, sig)
+	}
+
+	// collect descendants first, they are reparented once their parent dies
+	descendants := descendantPids(proc.Pid)
+	var err error
+	if group != NoProcessGroup {
+		err = syscall.Kill(-proc.Pid, sig)
+	} else {
+		err = c.sendSignal(proc, sig)
+	}
+	for _, pid := range descendants {
+		if kerr := syscall.Kill(pid, sig); kerr != nil && !errors.Is(kerr, syscall.ESRCH) {
+			log.Debugf("signal %d: %s", pid, kerr.Error())
+		}
+	}
+	return err
+}
+
+// descendantPids walks /proc and returns every live descendant of pid.
+func descendantPids(pid int) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		p, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		ppid, err := readPpid(p)
+		if err != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], p)
+	}
+
+	var pids []int
+	queue := children[pid]
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		pids = append(pids, p)
+		queue = append(queue, children[p]...)
+	}
+	return pids
+}
+
+func readPpid(pid int) (int, error) {
+	fields, err := readStatFields(pid)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// readStatFields returns the fields of /proc/pid/stat after comm, starting
+// with the state.
+func readStatFields(pid int) ([]string, error) {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return nil, err
+	}
+	// the comm field may contain spaces and parentheses, skip past the last ')'
+	stat := string(data)
+	i := strings.LastIndexByte(stat, ')')
+	if i < 0 {
+		return nil, errors.New("malformed stat for pid " + strconv.Itoa(pid))
+	}
+	fields := strings.Fields(stat[i+1:])
+	if len(fields) < 2 {
+		return nil, errors.New("malformed stat for pid " + strconv.Itoa(pid))
+	}
+	return fields, nil
+}
@@ -0,0 +1,12 @@
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// signalTree only reaches the subprocess itself, windows has no signals
+// beyond Kill.
+func (c *Cmd) signalTree(proc *os.Process, sig syscall.Signal, all bool) error {
+	return proc.Signal(sig)
+}
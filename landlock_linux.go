@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// LandlockMode decides what happens when the kernel cannot enforce the
+// requested Landlock rules.
+type LandlockMode int
+
+const (
+	// LandlockBestEffort enforces what the running kernel supports and runs
+	// the command unconfined when Landlock is missing entirely.
+	LandlockBestEffort LandlockMode = iota
+	// LandlockStrict fails the start when Landlock is not available.
+	LandlockStrict
+)
+
+var ErrLandlockUnsupported = errors.New("landlock is not supported by the kernel")
+
+// access rights added after ABI 1, missing in x/sys
+const (
+	landlockAccessFsTruncate = 0x4000 // ABI 3
+	landlockAccessFsIoctlDev = 0x8000 // ABI 5
+)
+
+const (
+	landlockAccessRead = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	landlockAccessExec = unix.LANDLOCK_ACCESS_FS_EXECUTE | landlockAccessRead
+	// write includes creating and removing entries below the path
+	landlockAccessWrite = unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM |
+		unix.LANDLOCK_ACCESS_FS_REFER |
+		landlockAccessFsTruncate |
+		landlockAccessFsIoctlDev
+
+	// rights that apply to a regular file rather than a directory
+	landlockAccessFile = unix.LANDLOCK_ACCESS_FS_EXECUTE |
+		unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		landlockAccessFsTruncate |
+		landlockAccessFsIoctlDev
+)
+
+type landlockRule struct {
+	Path   string `json:"path"`
+	Access uint64 `json:"access"`
+}
+
+type landlockConfig struct {
+	ABI   int            `json:"abi"`
+	Rules []landlockRule `json:"rules"`
+}
+
+// LandlockABI returns the Landlock ABI version of the running kernel, or
+// ErrLandlockUnsupported.
+func LandlockABI() (int, error) {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		if errno == syscall.ENOSYS || errno == syscall.EOPNOTSUPP {
+			return 0, ErrLandlockUnsupported
+		}
+		return 0, os.NewSyscallError("landlock_create_ruleset", errno)
+	}
+	return int(abi), nil
+}
+
+// landlockHandled returns the filesystem rights ABI abi can restrict.
+func landlockHandled(abi int) uint64 {
+	access := uint64(0x1fff)
+	if abi >= 2 {
+		access |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		access |= landlockAccessFsTruncate
+	}
+	if abi >= 5 {
+		access |= landlockAccessFsIoctlDev
+	}
+	return access
+}
+
+// AllowRead confines the subprocess with Landlock and lets it read files
+// and list directories below paths. Once any Allow* rule is set, everything
+// not allowed is denied, including the command binary and its shared
+// libraries, see AllowExec.
+func (c *Cmd) AllowRead(paths ...string) *Cmd {
+	return c.allowLandlock(landlockAccessRead, paths)
+}
+
+// AllowWrite lets the subprocess create, modify and remove files below paths.
+// Reading needs AllowRead as well.
+func (c *Cmd) AllowWrite(paths ...string) *Cmd {
+	return c.allowLandlock(landlockAccessWrite, paths)
+}
+
+// AllowExec lets the subprocess read and execute files below paths.
+func (c *Cmd) AllowExec(paths ...string) *Cmd {
+	return c.allowLandlock(landlockAccessExec, paths)
+}
+
+func (c *Cmd) SetLandlockMode(mode LandlockMode) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.landlockMode = mode
+	return c
+}
+
+func (c *Cmd) allowLandlock(access uint64, paths []string) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, path := range paths {
+		c.landlock = append(c.landlock, landlockRule{Path: path, Access: access})
+	}
+	return c
+}
+
+// landlockConfig resolves the rules for the trampoline, nil means no
+// confinement. The caller holds c.lock.
+func (c *Cmd) landlockConfig() (*landlockConfig, error) {
+	if len(c.landlock) == 0 {
+		return nil, nil
+	}
+	abi, err := LandlockABI()
+	if err != nil {
+		if c.landlockMode == LandlockStrict {
+			return nil, err
+		}
+		return nil, nil
+	}
+	cfg := &landlockConfig{ABI: abi}
+	for _, rule := range c.landlock {
+		path, err := filepath.Abs(rule.Path)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Rules = append(cfg.Rules, landlockRule{Path: path, Access: rule.Access})
+	}
+	return cfg, nil
+}
+
+// landlockError explains an exec refused by the Landlock rules.
+func (c *Cmd) landlockError(err error) error {
+	if len(c.landlock) == 0 || !errors.Is(err, syscall.EACCES) {
+		return err
+	}
+	return &PermissionError{Op: "landlock", Hint: "not allowed by the landlock rules, see AllowExec", Err: err}
+}
+
+// applyLandlock runs in the trampoline and restricts it, and so the command
+// it execs, to the rules. Paths that do not exist are skipped.
+func applyLandlock(cfg *landlockConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	handled := landlockHandled(cfg.ABI)
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return os.NewSyscallError("landlock_create_ruleset", errno)
+	}
+	ruleset := int(fd)
+	defer unix.Close(ruleset)
+
+	for _, rule := range cfg.Rules {
+		if err := addLandlockRule(ruleset, rule, handled); err != nil {
+			return err
+		}
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return os.NewSyscallError("prctl(PR_SET_NO_NEW_PRIVS)", err)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(ruleset), 0, 0); errno != 0 {
+		return os.NewSyscallError("landlock_restrict_self", errno)
+	}
+	return nil
+}
+
+func addLandlockRule(ruleset int, rule landlockRule, handled uint64) error {
+	fd, err := unix.Open(rule.Path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if err == syscall.ENOENT {
+			return nil
+		}
+		return os.NewSyscallError(fmt.Sprintf("open %s", rule.Path), err)
+	}
+	defer unix.Close(fd)
+
+	access := rule.Access & handled
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return os.NewSyscallError(fmt.Sprintf("stat %s", rule.Path), err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= landlockAccessFile
+	}
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return os.NewSyscallError(fmt.Sprintf("landlock_add_rule %s", rule.Path), errno)
+	}
+	return nil
+}
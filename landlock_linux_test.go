@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCmdLandlock(t *testing.T) {
+	if _, err := LandlockABI(); err != nil {
+		t.Skip(err)
+	}
+	in, out := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(in, "input"), []byte("data\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	system := []string{"/bin", "/usr", "/lib", "/lib64", "/etc"}
+	cmd := NewCmd().AllowExec(system...).AllowRead(in).AllowWrite(out).SetLandlockMode(LandlockStrict)
+	defer cmd.Close()
+	script := "cat " + in + "/input > " + out + "/output && echo ok; " +
+		"echo x > " + in + "/written; cat /proc/self/status > /dev/null"
+	res, err := cmd.RunCommandResult("/bin/sh", "-c", script)
+	if err == nil {
+		t.Fatal("expected the denied accesses to fail the script")
+	}
+	if strings.TrimSpace(string(res.Stdout)) != "ok" {
+		t.Fatalf("allowed accesses failed: %v %q", err, res.Stderr)
+	}
+	if data, _ := os.ReadFile(filepath.Join(out, "output")); string(data) != "data\n" {
+		t.Fatalf("unexpected output file %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(in, "written")); !os.IsNotExist(err) {
+		t.Fatal("write to a read-only path was allowed")
+	}
+	if !strings.Contains(string(res.Stderr), "Permission denied") {
+		t.Fatalf("unexpected stderr %q", res.Stderr)
+	}
+}
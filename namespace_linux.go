@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Namespace is a linux namespace the subprocess is created in.
+type Namespace uintptr
+
+const (
+	NamespaceUser   Namespace = syscall.CLONE_NEWUSER
+	NamespaceMount  Namespace = syscall.CLONE_NEWNS
+	NamespacePID    Namespace = syscall.CLONE_NEWPID
+	NamespaceNet    Namespace = syscall.CLONE_NEWNET
+	NamespaceUTS    Namespace = syscall.CLONE_NEWUTS
+	NamespaceIPC    Namespace = syscall.CLONE_NEWIPC
+	NamespaceCgroup Namespace = unix.CLONE_NEWCGROUP
+)
+
+func (ns Namespace) String() string {
+	var names []string
+	for _, n := range []struct {
+		ns   Namespace
+		name string
+	}{
+		{NamespaceUser, "user"},
+		{NamespaceMount, "mnt"},
+		{NamespacePID, "pid"},
+		{NamespaceNet, "net"},
+		{NamespaceUTS, "uts"},
+		{NamespaceIPC, "ipc"},
+		{NamespaceCgroup, "cgroup"},
+	} {
+		if ns&n.ns != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// NamespaceError is returned when the kernel refused to create the
+// requested namespaces.
+type NamespaceError struct {
+	Namespaces Namespace
+	Reason     string
+	Err        error
+}
+
+func (e *NamespaceError) Error() string {
+	msg := "create namespaces " + e.Namespaces.String()
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *NamespaceError) Unwrap() error {
+	return e.Err
+}
+
+// WithNamespaces creates the subprocess in new namespaces. Without explicit
+// mappings a user namespace maps the current uid/gid to root inside, so it
+// works without real root.
+func (c *Cmd) WithNamespaces(ns ...Namespace) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, n := range ns {
+		c.namespaces |= n
+	}
+	return c
+}
+
+func (c *Cmd) WithUIDMap(maps ...syscall.SysProcIDMap) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.uidMappings = append(c.uidMappings, maps...)
+	return c
+}
+
+func (c *Cmd) WithGIDMap(maps ...syscall.SysProcIDMap) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.gidMappings = append(c.gidMappings, maps...)
+	return c
+}
+
+// WithHostname sets the hostname inside a new UTS namespace.
+func (c *Cmd) WithHostname(hostname string) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.namespaces |= NamespaceUTS
+	c.hostname = hostname
+	return c
+}
+
+// applyNamespaces fills in SysProcAttr. The caller holds c.lock.
+func (c *Cmd) applyNamespaces() error {
+	if c.namespaces == 0 {
+		return nil
+	}
+	if c.namespaces&NamespaceUser != 0 {
+		if err := CheckUserNamespaces(); err != nil {
+			return err
+		}
+	}
+	if c.cmd.SysProcAttr == nil {
+		c.cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	attr := c.cmd.SysProcAttr
+	attr.Cloneflags |= uintptr(c.namespaces)
+	if c.namespaces&NamespaceUser == 0 {
+		return nil
+	}
+
+	attr.UidMappings = c.uidMappings
+	if len(attr.UidMappings) == 0 {
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	}
+	attr.GidMappings = c.gidMappings
+	if len(attr.GidMappings) == 0 {
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	}
+	// an unprivileged process may only write gid_map with setgroups denied
+	attr.GidMappingsEnableSetgroups = os.Geteuid() == 0
+	return nil
+}
+
+// namespaceError explains a failed start when namespaces were requested.
+func (c *Cmd) namespaceError(err error) error {
+	if c.namespaces == 0 {
+		return err
+	}
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return err
+	}
+	nsErr := &NamespaceError{Namespaces: c.namespaces, Err: err}
+	switch errno {
+	case syscall.EPERM:
+		if c.namespaces&NamespaceUser == 0 && os.Geteuid() != 0 {
+			nsErr.Reason = "CAP_SYS_ADMIN is required without a user namespace"
+		} else if reason := userNamespaceRestriction(); reason != "" {
+			nsErr.Reason = reason
+		}
+	case syscall.EINVAL:
+		nsErr.Reason = "namespace not supported by the kernel"
+	case syscall.ENOSPC, syscall.EUSERS:
+		nsErr.Reason = "namespace limit reached, see /proc/sys/user/max_*_namespaces"
+	default:
+		return err
+	}
+	return nsErr
+}
+
+// CheckUserNamespaces reports whether the current process may create a user
+// namespace, based on the kernel and sysctl settings.
+func CheckUserNamespaces() error {
+	if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+		return &NamespaceError{Namespaces: NamespaceUser, Reason: "kernel built without user namespaces", Err: err}
+	}
+	if readSysctl("user/max_user_namespaces") == "0" {
+		return &NamespaceError{Namespaces: NamespaceUser, Reason: "disabled by user.max_user_namespaces=0"}
+	}
+	if os.Geteuid() != 0 && readSysctl("kernel/unprivileged_userns_clone") == "0" {
+		return &NamespaceError{Namespaces: NamespaceUser, Reason: "unprivileged user namespaces disabled by kernel.unprivileged_userns_clone=0"}
+	}
+	return nil
+}
+
+func userNamespaceRestriction() string {
+	if os.Geteuid() != 0 && readSysctl("kernel/apparmor_restrict_unprivileged_userns") == "1" {
+		return "unprivileged user namespaces restricted by kernel.apparmor_restrict_unprivileged_userns=1"
+	}
+	if readSysctl("user/max_user_namespaces") == "0" {
+		return "disabled by user.max_user_namespaces=0"
+	}
+	return fmt.Sprintf("not permitted for uid %d", os.Geteuid())
+}
+
+func readSysctl(name string) string {
+	data, err := os.ReadFile("/proc/sys/" + name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCmdNamespaces(t *testing.T) {
+	if err := CheckUserNamespaces(); err != nil {
+		t.Skip(err)
+	}
+	cmd := NewCmd().WithNamespaces(NamespaceUser, NamespaceNet).WithHostname("sandbox")
+	defer cmd.Close()
+	out, err := cmd.RunCommand("/bin/sh", "-c", "hostname; id -u; readlink /proc/self/ns/net")
+	var nsErr *NamespaceError
+	if errors.As(err, &nsErr) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 3 || lines[0] != "sandbox" || lines[1] != "0" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	self, _ := os.Readlink("/proc/self/ns/net")
+	if lines[2] == self {
+		t.Fatalf("subprocess shares the network namespace %s", self)
+	}
+}
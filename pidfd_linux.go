@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// openPidfd gets a pidfd for the subprocess right after it was started,
+// before it can be reaped, so signals sent through it never hit a recycled
+// pid. Before linux 5.3 there is none and signals are sent by pid. The
+// caller holds c.lock.
+func (c *Cmd) openPidfd() {
+	c.closePidfd()
+	pidfd, err := pidfdOpen(c.cmd.Process.Pid)
+	if err != nil {
+		if c.debug {
+			log.Infof("no pidfd for pid %d, signalling by pid: %s", c.cmd.Process.Pid, err.Error())
+		}
+		return
+	}
+	c.pidfd = pidfd
+}
+
+// pidfdOpen opens a non-blocking pidfd, so the runtime poller can wait for
+// the exit.
+func pidfdOpen(pid int) (*os.File, error) {
+	fd, err := unix.PidfdOpen(pid, unix.PIDFD_NONBLOCK)
+	if errors.Is(err, unix.EINVAL) {
+		// PIDFD_NONBLOCK is only known since linux 5.10
+		if fd, err = unix.PidfdOpen(pid, 0); err == nil {
+			if err = unix.SetNonblock(fd, true); err != nil {
+				unix.Close(fd)
+			}
+		}
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("pidfd_open", err)
+	}
+	return os.NewFile(uintptr(fd), "pidfd"), nil
+}
+
+// closePidfd closes the pidfd of the previous run. The caller holds
+// c.lock.
+func (c *Cmd) closePidfd() {
+	if c.pidfd != nil {
+		c.pidfd.Close()
+		c.pidfd = nil
+	}
+}
+
+// sendSignal signals proc, through the pidfd when proc is the subprocess.
+func (c *Cmd) sendSignal(proc *os.Process, sig syscall.Signal) error {
+	c.lock.RLock()
+	pidfd := c.pidfd
+	if proc != c.cmd.Process {
+		pidfd = nil
+	}
+	c.lock.RUnlock()
+	return signalPidfd(pidfd, proc, sig)
+}
+
+func signalPidfd(pidfd *os.File, proc *os.Process, sig syscall.Signal) error {
+	if pidfd == nil {
+		return proc.Signal(sig)
+	}
+	var err error
+	if ctrlErr := rawControl(pidfd, func(fd int) {
+		err = unix.PidfdSendSignal(fd, sig, nil, 0)
+	}); ctrlErr != nil {
+		// closed by Close
+		return proc.Signal(sig)
+	}
+	if errors.Is(err, unix.ESRCH) {
+		return os.ErrProcessDone
+	}
+	if err != nil {
+		return os.NewSyscallError("pidfd_send_signal", err)
+	}
+	return nil
+}
+
+// watchExit closes exited once the pidfd is readable, which is as soon as
+// the subprocess exits, or once it was reaped without a pidfd.
+func watchExit(pidfd *os.File, done <-chan struct{}, exited chan struct{}) {
+	defer close(exited)
+	if pidfd != nil && waitPidfd(pidfd) == nil {
+		return
+	}
+	<-done
+}
+
+// waitPidfd blocks until the process has exited and its pidfd is readable,
+// or until the read deadline of pidfd.
+func waitPidfd(pidfd *os.File) error {
+	conn, err := pidfd.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return conn.Read(func(fd uintptr) bool {
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, 0)
+		return err == nil && n > 0
+	})
+}
+
+// PidFD returns the pidfd of the subprocess, e.g. to wait for its exit with
+// poll or epoll, it becomes readable then. It stays owned by the Cmd and is
+// valid until Close or the next Command. ok is false without pidfd support.
+func (c *Cmd) PidFD() (fd int, ok bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.pidfd == nil {
+		return -1, false
+	}
+	if err := rawControl(c.pidfd, func(pidfd int) { fd = pidfd }); err != nil {
+		return -1, false
+	}
+	return fd, true
+}
+
+// Exited returns a channel that is closed as soon as the subprocess has
+// exited, before its output is drained and Run returns. Without pidfd
+// support it is closed once the subprocess was reaped. It is nil before
+// Command.
+func (c *Cmd) Exited() <-chan struct{} {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.exited
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCmdPidfd(t *testing.T) {
+	cmd := NewCmd()
+	defer cmd.Close()
+	// the grandchild keeps stdout open after the shell exited
+	if _, err := cmd.Command("/bin/sh", "-c", "(sleep 1; echo late) & sleep 0.2"); err != nil {
+		t.Fatal(err)
+	}
+	fd, ok := cmd.PidFD()
+	if !ok {
+		t.Skip("no pidfd support")
+	}
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	if n, err := unix.Poll(fds, 0); err != nil || n != 0 {
+		t.Fatalf("pidfd readable before exit: %d %v", n, err)
+	}
+	if err := cmd.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	select {
+	case <-cmd.Exited():
+	case <-time.After(2 * time.Second):
+		t.Fatal("no exit notification")
+	}
+	if time.Since(start) > 800*time.Millisecond {
+		t.Fatalf("exit notified after %s, not before the output was drained", time.Since(start))
+	}
+	if n, err := unix.Poll(fds, 0); err != nil || n != 1 {
+		t.Fatalf("pidfd not readable after exit: %d %v", n, err)
+	}
+	out, err := cmd.Run()
+	if err != nil || string(out) != "late\n" {
+		t.Fatalf("unexpected output %q %v", out, err)
+	}
+
+	// reaped, the pid is never signalled again
+	if err := cmd.Pause(); !errors.Is(err, os.ErrProcessDone) {
+		t.Fatalf("expected ErrProcessDone, got %v", err)
+	}
+}
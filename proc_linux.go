@@ -0,0 +1,347 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of the times in /proc/pid/stat. It is 100
+// on all architectures Go supports.
+const clockTicks = 100
+
+// ProcessState is the state letter of a process in /proc/pid/stat.
+type ProcessState byte
+
+const (
+	ProcessRunning     ProcessState = 'R'
+	ProcessSleeping    ProcessState = 'S'
+	ProcessDiskSleep   ProcessState = 'D'
+	ProcessStopped     ProcessState = 'T'
+	ProcessTracingStop ProcessState = 't'
+	ProcessZombie      ProcessState = 'Z'
+	ProcessDead        ProcessState = 'X'
+	ProcessIdle        ProcessState = 'I'
+)
+
+func (s ProcessState) String() string {
+	switch s {
+	case ProcessRunning:
+		return "running"
+	case ProcessSleeping:
+		return "sleeping"
+	case ProcessDiskSleep:
+		return "disk sleep"
+	case ProcessStopped:
+		return "stopped"
+	case ProcessTracingStop:
+		return "tracing stop"
+	case ProcessZombie:
+		return "zombie"
+	case ProcessDead:
+		return "dead"
+	case ProcessIdle:
+		return "idle"
+	default:
+		return string(s)
+	}
+}
+
+// ProcessInfo is what /proc tells about a process. Cmdline, Environ, Cwd,
+// Exe, FDs and Limits are left empty when they cannot be read, e.g. for a
+// process of another user or a zombie.
+type ProcessInfo struct {
+	Pid       int
+	PPid      int
+	Pgid      int
+	Sid       int
+	Comm      string
+	State     ProcessState
+	Threads   int
+	RSS       uint64
+	VSize     uint64
+	UTime     time.Duration
+	STime     time.Duration
+	StartTime time.Time
+	// Uids and Gids are the real, effective, saved and filesystem ids.
+	Uids    []int
+	Gids    []int
+	Cmdline []string
+	Environ []string
+	Cwd     string
+	Exe     string
+	// FDs maps the open file descriptors to what they refer to, e.g. a path
+	// or "pipe:[1234]".
+	FDs    map[int]string
+	Limits []Rlimit
+}
+
+// ReadProcessInfo reads the information about pid from /proc.
+func ReadProcessInfo(pid int) (*ProcessInfo, error) {
+	info, err := readProcessSummary(pid)
+	if err != nil {
+		return nil, err
+	}
+	if err := info.readDetails(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// readProcessSummary reads what is needed to pick out a process, without
+// the environment, file descriptors and limits.
+func readProcessSummary(pid int) (*ProcessInfo, error) {
+	info := &ProcessInfo{Pid: pid}
+	if err := info.readStat(); err != nil {
+		return nil, err
+	}
+	if err := info.readStatus(); err != nil {
+		return nil, err
+	}
+	dir := procDir(pid)
+	var err error
+	if data, rerr := os.ReadFile(dir + "/cmdline"); skipProcErr(&err, rerr) {
+		info.Cmdline = splitNul(data)
+	}
+	if exe, rerr := os.Readlink(dir + "/exe"); skipProcErr(&err, rerr) {
+		info.Exe = exe
+	}
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (info *ProcessInfo) readDetails() error {
+	dir := procDir(info.Pid)
+	var err error
+	if data, rerr := os.ReadFile(dir + "/environ"); skipProcErr(&err, rerr) {
+		info.Environ = splitNul(data)
+	}
+	if cwd, rerr := os.Readlink(dir + "/cwd"); skipProcErr(&err, rerr) {
+		info.Cwd = cwd
+	}
+	if fds, rerr := readFDs(dir); skipProcErr(&err, rerr) {
+		info.FDs = fds
+	}
+	if limits, rerr := readLimits(dir); skipProcErr(&err, rerr) {
+		info.Limits = limits
+	}
+	return err
+}
+
+// Info returns the /proc information about the subprocess while it runs.
+func (c *Cmd) Info() (*ProcessInfo, error) {
+	c.lock.RLock()
+	pid := c.pid
+	done := c.waitDone
+	c.lock.RUnlock()
+	if pid == 0 || done == nil {
+		return nil, ErrSubprocessExited
+	}
+	select {
+	case <-done:
+		// the pid may belong to another process by now
+		return nil, ErrSubprocessExited
+	default:
+	}
+	return ReadProcessInfo(pid)
+}
+
+func procDir(pid int) string {
+	return "/proc/" + strconv.Itoa(pid)
+}
+
+// skipProcErr reports whether rerr is nil. Permission errors and files
+// that are gone, e.g. the exe link of a zombie, are skipped, others are
+// kept in err.
+func skipProcErr(err *error, rerr error) bool {
+	if rerr == nil {
+		return true
+	}
+	if !errors.Is(rerr, os.ErrPermission) && !errors.Is(rerr, os.ErrNotExist) && *err == nil {
+		*err = rerr
+	}
+	return false
+}
+
+func (info *ProcessInfo) readStat() error {
+	fields, err := readStatFields(info.Pid)
+	if err != nil {
+		return err
+	}
+	if len(fields) < 22 {
+		return errors.New("malformed stat for pid " + strconv.Itoa(info.Pid))
+	}
+	info.State = ProcessState(fields[0][0])
+	ints := make([]uint64, len(fields))
+	for _, i := range []int{1, 2, 3, 11, 12, 17, 19, 20, 21} {
+		if ints[i], err = strconv.ParseUint(fields[i], 10, 64); err != nil {
+			return fmt.Errorf("malformed stat for pid %d: %w", info.Pid, err)
+		}
+	}
+	info.PPid = int(ints[1])
+	info.Pgid = int(ints[2])
+	info.Sid = int(ints[3])
+	info.UTime = ticksToDuration(ints[11])
+	info.STime = ticksToDuration(ints[12])
+	info.Threads = int(ints[17])
+	info.VSize = ints[20]
+	info.RSS = ints[21] * uint64(os.Getpagesize())
+	info.StartTime, err = startTime(ints[19])
+	return err
+}
+
+// readStartTime returns when pid was started, which tells it apart from a
+// later process with the same pid, and its state.
+func readStartTime(pid int) (time.Time, ProcessState, error) {
+	fields, err := readStatFields(pid)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if len(fields) < 20 {
+		return time.Time{}, 0, errors.New("malformed stat for pid " + strconv.Itoa(pid))
+	}
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("malformed stat for pid %d: %w", pid, err)
+	}
+	started, err := startTime(ticks)
+	return started, ProcessState(fields[0][0]), err
+}
+
+// startTime converts the start time in ticks since boot.
+func startTime(ticks uint64) (time.Time, error) {
+	boot, err := bootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return boot.Add(ticksToDuration(ticks)), nil
+}
+
+func (info *ProcessInfo) readStatus() error {
+	f, err := os.Open(procDir(info.Pid) + "/status")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "Name":
+			info.Comm = strings.TrimSpace(value)
+		case "Uid":
+			info.Uids = parseInts(value)
+		case "Gid":
+			info.Gids = parseInts(value)
+		}
+	}
+	return scanner.Err()
+}
+
+func readFDs(dir string) (map[int]string, error) {
+	entries, err := os.ReadDir(dir + "/fd")
+	if err != nil {
+		return nil, err
+	}
+	fds := make(map[int]string, len(entries))
+	for _, entry := range entries {
+		fd, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// closed in the meantime
+		if target, err := os.Readlink(dir + "/fd/" + entry.Name()); err == nil {
+			fds[fd] = target
+		}
+	}
+	return fds, nil
+}
+
+// readLimits parses the limits file. Its lines are in the order of the
+// RLIMIT_* constants and the columns have fixed widths.
+func readLimits(dir string) ([]Rlimit, error) {
+	data, err := os.ReadFile(dir + "/limits")
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	limits := make([]Rlimit, 0, len(lines)-1)
+	for i, line := range lines[1:] {
+		if len(line) < 67 {
+			return nil, errors.New("malformed limits line " + strconv.Quote(line))
+		}
+		soft, err := parseLimit(line[26:46])
+		if err != nil {
+			return nil, err
+		}
+		hard, err := parseLimit(line[47:67])
+		if err != nil {
+			return nil, err
+		}
+		limits = append(limits, Rlimit{Resource: i, Soft: soft, Hard: hard})
+	}
+	return limits, nil
+}
+
+func parseLimit(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "unlimited" {
+		return RlimInfinity, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+func parseInts(s string) []int {
+	var ints []int
+	for _, field := range strings.Fields(s) {
+		if n, err := strconv.Atoi(field); err == nil {
+			ints = append(ints, n)
+		}
+	}
+	return ints
+}
+
+func splitNul(data []byte) []string {
+	data = bytes.TrimSuffix(data, []byte{0})
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(string(data), "\x00")
+}
+
+func ticksToDuration(ticks uint64) time.Duration {
+	return time.Duration(ticks) * time.Second / clockTicks
+}
+
+// bootTime reads the btime line of /proc/stat.
+func bootTime() (time.Time, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "btime ") {
+			sec, err := strconv.ParseInt(strings.TrimSpace(line[len("btime "):]), 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(sec, 0), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return time.Time{}, errors.New("no btime in /proc/stat")
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadProcessInfo(t *testing.T) {
+	f, err := os.Open("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	info, err := ReadProcessInfo(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe, _ := os.Executable()
+	wd, _ := os.Getwd()
+	if info.PPid != os.Getppid() || info.Pgid != syscall.Getpgrp() || info.Exe != exe || info.Cwd != wd {
+		t.Fatalf("unexpected ids or paths %d %d %s %s", info.PPid, info.Pgid, info.Exe, info.Cwd)
+	}
+	if info.State == ProcessZombie || info.Threads < 1 || info.RSS == 0 || len(info.Uids) != 4 || info.Uids[0] != os.Getuid() {
+		t.Fatalf("unexpected state %s, %d threads, rss %d, uids %v", info.State, info.Threads, info.RSS, info.Uids)
+	}
+	if !reflect.DeepEqual(info.Cmdline, os.Args) || len(info.Environ) == 0 {
+		t.Fatalf("unexpected cmdline %q", info.Cmdline)
+	}
+	if since := time.Since(info.StartTime); since < 0 || since > time.Hour {
+		t.Fatalf("unexpected start time %s", info.StartTime)
+	}
+	if info.FDs[int(f.Fd())] != "/dev/null" {
+		t.Fatalf("unexpected fds %v", info.FDs)
+	}
+	var nofile syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &nofile); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Limits) <= syscall.RLIMIT_NOFILE || info.Limits[syscall.RLIMIT_NOFILE].Soft != nofile.Cur {
+		t.Fatalf("unexpected limits %v", info.Limits)
+	}
+
+	if _, err := ReadProcessInfo(1 << 30); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestCmdInfo(t *testing.T) {
+	dir := t.TempDir()
+	cmd := NewCmd().SetWorkDir(dir)
+	defer cmd.Close()
+	if _, err := cmd.Info(); !errors.Is(err, ErrSubprocessExited) {
+		t.Fatalf("expected ErrSubprocessExited before start, got %v", err)
+	}
+	pid, err := cmd.Command("sleep", "0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := cmd.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Pid != pid || info.PPid != os.Getpid() || info.Cwd != dir || info.Comm != "sleep" {
+		t.Fatalf("unexpected info %d %d %s %s", info.Pid, info.PPid, info.Cwd, info.Comm)
+	}
+	if !reflect.DeepEqual(info.Cmdline, []string{"sleep", "0.5"}) ||
+		(info.State != ProcessSleeping && info.State != ProcessRunning) {
+		t.Fatalf("unexpected cmdline %q in state %s", info.Cmdline, info.State)
+	}
+	if _, err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cmd.Info(); !errors.Is(err, ErrSubprocessExited) {
+		t.Fatalf("expected ErrSubprocessExited after exit, got %v", err)
+	}
+}
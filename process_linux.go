@@ -0,0 +1,258 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// processPollInterval is how often Wait checks /proc for the exit of a
+// process without a pidfd.
+const processPollInterval = 100 * time.Millisecond
+
+// Process is a handle on any process, e.g. one started by another tool. It
+// refers to the process through a pidfd where the kernel supports it, and
+// otherwise checks its start time before every signal, so a recycled pid
+// is never mistaken for it. Once the process is gone the methods return
+// os.ErrProcessDone.
+type Process struct {
+	Pid     int
+	started time.Time
+	lock    sync.Mutex
+	pidfd   *os.File
+}
+
+// OpenProcess attaches to the process pid.
+func OpenProcess(pid int) (*Process, error) {
+	p := &Process{Pid: pid}
+	pidfd, err := pidfdOpen(pid)
+	switch {
+	case err == nil:
+		p.pidfd = pidfd
+	case errors.Is(err, syscall.ESRCH):
+		return nil, os.ErrProcessDone
+	}
+	started, state, err := readStartTime(pid)
+	if err != nil {
+		p.Close()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, os.ErrProcessDone
+		}
+		return nil, err
+	}
+	p.started = started
+	if state == ProcessZombie || state == ProcessDead {
+		p.Close()
+		return nil, os.ErrProcessDone
+	}
+	return p, nil
+}
+
+// OpenProcessPidfd attaches to the process fd refers to. The caller keeps
+// fd and has to close it.
+func OpenProcessPidfd(fd int) (*Process, error) {
+	pid, err := pidfdPid(fd)
+	if err != nil {
+		return nil, err
+	}
+	p, err := OpenProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+	// still alive, so pid was not given to another process meanwhile
+	if err = unix.PidfdSendSignal(fd, 0, nil, 0); err != nil {
+		p.Close()
+		if errors.Is(err, unix.ESRCH) {
+			return nil, os.ErrProcessDone
+		}
+		return nil, os.NewSyscallError("pidfd_send_signal", err)
+	}
+	return p, nil
+}
+
+// pidfdPid reads the pid a pidfd refers to from its fdinfo.
+func pidfdPid(fd int) (int, error) {
+	f, err := os.Open("/proc/self/fdinfo/" + strconv.Itoa(fd))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || key != "Pid" {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return 0, err
+		}
+		if pid <= 0 {
+			// -1 once the process has exited
+			return 0, os.ErrProcessDone
+		}
+		return pid, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("fd " + strconv.Itoa(fd) + " is not a pidfd")
+}
+
+// Signal sends sig to the process. Signal 0 only checks that it is alive.
+func (p *Process) Signal(sig syscall.Signal) error {
+	p.lock.Lock()
+	pidfd := p.pidfd
+	p.lock.Unlock()
+	// an unreaped zombie still takes signals
+	if !p.alive() {
+		return os.ErrProcessDone
+	}
+	if pidfd != nil {
+		var err error
+		if ctrlErr := rawControl(pidfd, func(fd int) {
+			err = unix.PidfdSendSignal(fd, sig, nil, 0)
+		}); ctrlErr != nil {
+			return ctrlErr
+		}
+		if errors.Is(err, unix.ESRCH) {
+			return os.ErrProcessDone
+		}
+		if err != nil {
+			return os.NewSyscallError("pidfd_send_signal", err)
+		}
+		return nil
+	}
+	if err := syscall.Kill(p.Pid, sig); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return os.ErrProcessDone
+		}
+		return os.NewSyscallError("kill", err)
+	}
+	return nil
+}
+
+// Pause stops the process with SIGSTOP, which it cannot ignore.
+func (p *Process) Pause() error {
+	return p.Signal(syscall.SIGSTOP)
+}
+
+// Resume continues the process after Pause.
+func (p *Process) Resume() error {
+	return p.Signal(syscall.SIGCONT)
+}
+
+// Wait blocks until the process has exited or ctx is done. The process
+// does not have to be a child, it is not reaped and its exit status is
+// not known.
+func (p *Process) Wait(ctx context.Context) error {
+	p.lock.Lock()
+	pidfd := p.pidfd
+	p.lock.Unlock()
+	if pidfd != nil {
+		err := p.waitPidfd(ctx, pidfd)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// not pollable, fall back to /proc
+	}
+
+	ticker := time.NewTicker(processPollInterval)
+	defer ticker.Stop()
+	for p.alive() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// waitPidfd waits on the pidfd and interrupts the wait with a read deadline
+// when ctx is done.
+func (p *Process) waitPidfd(ctx context.Context, pidfd *os.File) error {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			pidfd.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	err := waitPidfd(pidfd)
+	close(stop)
+	wg.Wait()
+	pidfd.SetReadDeadline(time.Time{})
+	return err
+}
+
+// Exited reports whether the process has exited, zombies included.
+func (p *Process) Exited() bool {
+	return !p.alive()
+}
+
+// Info returns the /proc information about the process.
+func (p *Process) Info() (*ProcessInfo, error) {
+	info, err := ReadProcessInfo(p.Pid)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && !info.StartTime.Equal(p.started)) {
+		return nil, os.ErrProcessDone
+	}
+	return info, err
+}
+
+// State returns the state of the process, e.g. ProcessStopped after Pause.
+func (p *Process) State() (ProcessState, error) {
+	started, state, err := readStartTime(p.Pid)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && !started.Equal(p.started)) {
+		return 0, os.ErrProcessDone
+	}
+	return state, err
+}
+
+// PidFD returns the pidfd of the process, it becomes readable once the
+// process exits. It stays owned by the Process and is valid until Close.
+// ok is false without pidfd support.
+func (p *Process) PidFD() (fd int, ok bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pidfd == nil {
+		return -1, false
+	}
+	if err := rawControl(p.pidfd, func(pidfd int) { fd = pidfd }); err != nil {
+		return -1, false
+	}
+	return fd, true
+}
+
+// Close releases the pidfd, the process is not affected.
+func (p *Process) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pidfd == nil {
+		return nil
+	}
+	err := p.pidfd.Close()
+	p.pidfd = nil
+	return err
+}
+
+// alive checks /proc for a live process with the same pid and start time.
+func (p *Process) alive() bool {
+	started, state, err := readStartTime(p.Pid)
+	return err == nil && started.Equal(p.started) && state != ProcessZombie && state != ProcessDead
+}
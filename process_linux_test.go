@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// startOrphan starts sleep as a grandchild that is not waited for by us.
+func startOrphan(t *testing.T) int {
+	out, err := NewCmd().RunCommand("/bin/sh", "-c", "sleep 5 > /dev/null 2>&1 & echo $!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Kill(pid, syscall.SIGKILL) })
+	return pid
+}
+
+func waitState(t *testing.T, p *Process, want ProcessState) {
+	for i := 0; i < 100; i++ {
+		state, err := p.State()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state == want || (want == ProcessSleeping && state != ProcessStopped) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("process not %s", want)
+}
+
+func TestProcess(t *testing.T) {
+	pid := startOrphan(t)
+	p, err := OpenProcess(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	info, err := p.Info()
+	if err != nil || !reflect.DeepEqual(info.Cmdline, []string{"sleep", "5"}) {
+		t.Fatalf("unexpected info %v", err)
+	}
+
+	if err := p.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, p, ProcessStopped)
+	if err := p.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, p, ProcessSleeping)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if p.Exited() {
+		t.Fatal("exited too early")
+	}
+
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := p.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Exited() {
+		t.Fatal("not exited after Wait")
+	}
+	if err := p.Signal(syscall.SIGTERM); !errors.Is(err, os.ErrProcessDone) {
+		t.Fatalf("expected ErrProcessDone, got %v", err)
+	}
+
+	if _, err := OpenProcess(1 << 30); !errors.Is(err, os.ErrProcessDone) {
+		t.Fatalf("expected ErrProcessDone, got %v", err)
+	}
+}
+
+func TestProcessPidfd(t *testing.T) {
+	pid := startOrphan(t)
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		t.Skip("no pidfd support")
+	}
+	defer unix.Close(fd)
+	p, err := OpenProcessPidfd(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if p.Pid != pid {
+		t.Fatalf("attached to %d instead of %d", p.Pid, pid)
+	}
+	if _, ok := p.PidFD(); !ok {
+		t.Fatal("no pidfd")
+	}
+
+	// without a pidfd signals are checked against the start time
+	p.Close()
+	if err := p.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, p, ProcessStopped)
+	if err := p.Signal(syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := p.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Resume(); !errors.Is(err, os.ErrProcessDone) {
+		t.Fatalf("expected ErrProcessDone, got %v", err)
+	}
+}
@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"syscall"
+)
+
+// waitTraceStop waits until the traced subprocess is stopped at exec. Unlike
+// waitid, wait4 cannot leave an exit to Wait, but the subprocess only exits
+// before the stop when it is killed.
+func waitTraceStop(pid int) {
+	var ws syscall.WaitStatus
+	for {
+		_, err := syscall.Wait4(pid, &ws, syscall.WUNTRACED, nil)
+		if err != syscall.EINTR {
+			return
+		}
+	}
+}
+
+// detachTraced continues the subprocess where it stopped, at address 1.
+func detachTraced(pid int) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, syscall.PT_DETACH, uintptr(pid), 1, 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
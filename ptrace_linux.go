@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitTraceStop waits until the traced subprocess is stopped at exec, or
+// has exited, without reaping it.
+func waitTraceStop(pid int) {
+	var info unix.Siginfo
+	for {
+		err := unix.Waitid(unix.P_PID, pid, &info, unix.WSTOPPED|unix.WEXITED|unix.WNOWAIT, nil)
+		if !errors.Is(err, unix.EINTR) {
+			return
+		}
+	}
+}
+
+func detachTraced(pid int) error {
+	return unix.PtraceDetach(pid)
+}
+
+// traceable reports whether path can be held at exec with ptrace. Yama may
+// restrict PTRACE_TRACEME to privileged parents, and a traced exec ignores
+// the set-user-ID and set-group-ID bits and the file capabilities unless
+// the parent is privileged.
+func traceable(path string) bool {
+	scope := yamaPtraceScope()
+	if os.Geteuid() == 0 {
+		return scope < 3
+	}
+	if scope >= 2 {
+		return false
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		// reported by Start
+		return true
+	}
+	if fi.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 {
+		return false
+	}
+	_, err = unix.Getxattr(path, "security.capability", nil)
+	return err != nil
+}
+
+func yamaPtraceScope() int {
+	data, err := os.ReadFile("/proc/sys/kernel/yama/ptrace_scope")
+	if err != nil {
+		return 0
+	}
+	scope, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return scope
+}
@@ -0,0 +1,92 @@
+//go:build linux || darwin
+
+package utils
+
+import (
+	"errors"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// traceHold keeps a subprocess started with SysProcAttr.Ptrace stopped at
+// exec, before it runs a single instruction of the command. The requests
+// have to come from the thread that started the tracee, so a goroutine
+// locked to its thread starts the command and detaches it on release.
+type traceHold struct {
+	released chan struct{}
+	done     chan struct{}
+	err      error
+}
+
+// startTraced starts cmd traced and returns once it is stopped at exec, or
+// has exited. The SysProcAttr of cmd is copied, as it may be shared.
+func startTraced(cmd *exec.Cmd) (*traceHold, error) {
+	attr := syscall.SysProcAttr{}
+	if cmd.SysProcAttr != nil {
+		attr = *cmd.SysProcAttr
+	}
+	attr.Ptrace = true
+	cmd.SysProcAttr = &attr
+
+	h := &traceHold{
+		released: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	started := make(chan error)
+	go func() {
+		defer close(h.done)
+		runtime.LockOSThread()
+		if err := cmd.Start(); err != nil {
+			runtime.UnlockOSThread()
+			started <- err
+			return
+		}
+		pid := cmd.Process.Pid
+		waitTraceStop(pid)
+		started <- nil
+		<-h.released
+		// one killed while it was held is gone already
+		err := detachTraced(pid)
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			// the thread exits with the goroutine, which detaches it too
+			h.err = err
+			return
+		}
+		runtime.UnlockOSThread()
+	}()
+	if err := <-started; err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// release lets the subprocess run and waits until it was detached. A
+// signal sent while it was held is delivered before the command runs. It
+// must be called once.
+func (h *traceHold) release() error {
+	if h == nil {
+		return nil
+	}
+	close(h.released)
+	<-h.done
+	return h.err
+}
+
+// wait blocks until the subprocess was released, it must not be waited for
+// before: the stop at exec would be reported as its exit.
+func (h *traceHold) wait() {
+	if h != nil {
+		<-h.done
+	}
+}
+
+// releaseTrace lets a subprocess held at exec run, e.g. to handle a signal
+// sent to it.
+func (c *Cmd) releaseTrace() {
+	c.lock.Lock()
+	trace := c.trace
+	c.trace = nil
+	c.lock.Unlock()
+	trace.release()
+}
@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultPtyRows = 24
+	defaultPtyCols = 80
+)
+
+// WindowSize is the terminal size of a subprocess run with SetPty.
+type WindowSize struct {
+	Rows uint16
+	Cols uint16
+}
+
+// SetPty runs the subprocess on a pseudo-terminal instead of pipes. The
+// terminal becomes its controlling terminal and stdin, stdout and stderr
+// are all connected to it, so stderr output shows up in GetOutput and
+// GetStderrOutput stays empty. The terminal translates "\n" to "\r\n" and
+// echoes input, CloseInput sends the EOF character ^D. The subprocess always
+// runs in a new session.
+func (c *Cmd) SetPty(pty bool) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pty = pty
+	return c
+}
+
+// SetWindowSize sets the terminal size, before the command is started or
+// while it is running, in which case it receives SIGWINCH.
+func (c *Cmd) SetWindowSize(size WindowSize) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.winSize = size
+	if c.ptyMaster == nil {
+		return nil
+	}
+	return setWinsize(c.ptyMaster, c.windowSize())
+}
+
+// GetWindowSize returns the terminal size, as set or as changed by the
+// subprocess.
+func (c *Cmd) GetWindowSize() (WindowSize, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.ptyMaster == nil {
+		return c.windowSize(), nil
+	}
+	var ws *unix.Winsize
+	var err error
+	ctrlErr := rawControl(c.ptyMaster, func(fd int) {
+		ws, err = unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+	})
+	if ctrlErr != nil {
+		return WindowSize{}, ctrlErr
+	}
+	if err != nil {
+		return WindowSize{}, os.NewSyscallError("ioctl TIOCGWINSZ", err)
+	}
+	return WindowSize{Rows: ws.Row, Cols: ws.Col}, nil
+}
+
+func (c *Cmd) windowSize() WindowSize {
+	size := c.winSize
+	if size.Rows == 0 {
+		size.Rows = defaultPtyRows
+	}
+	if size.Cols == 0 {
+		size.Cols = defaultPtyCols
+	}
+	return size
+}
+
+// setupPty connects the command to a new pseudo-terminal in place of the
+// pipes. The caller holds c.lock.
+func (c *Cmd) setupPty() error {
+	master, slave, err := openPty()
+	if err != nil {
+		return err
+	}
+	if err = setWinsize(master, c.windowSize()); err != nil {
+		master.Close()
+		slave.Close()
+		return err
+	}
+	c.cmd.Stdin = slave
+	c.cmd.Stdout = slave
+	c.cmd.Stderr = slave
+	if c.cmd.SysProcAttr == nil {
+		c.cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	// a session leader cannot change its process group
+	c.cmd.SysProcAttr.Setsid = true
+	c.cmd.SysProcAttr.Setpgid = false
+	c.cmd.SysProcAttr.Setctty = true
+	c.cmd.SysProcAttr.Ctty = 0
+
+	c.ptyMaster = master
+	c.ptySlave = slave
+	c.stdout = ptyReader{master}
+	c.stdoutbuf = NewReader(c.stdout)
+	c.stderr = nil
+	c.stderrbuf = NewReader(io.NopCloser(strings.NewReader("")))
+	c.stdin = ptyInput{master}
+	return nil
+}
+
+// closePtySlave closes the parent's copy of the terminal once the command
+// was started, so reading the master ends when the subprocess exits.
+func (c *Cmd) closePtySlave() {
+	if c.ptySlave != nil {
+		c.ptySlave.Close()
+		c.ptySlave = nil
+	}
+}
+
+// openPty allocates a pseudo-terminal pair from /dev/ptmx.
+func openPty() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var n int
+	ctrlErr := rawControl(master, func(fd int) {
+		if err = unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+			err = os.NewSyscallError("ioctl TIOCSPTLCK", err)
+			return
+		}
+		if n, err = unix.IoctlGetInt(fd, unix.TIOCGPTN); err != nil {
+			err = os.NewSyscallError("ioctl TIOCGPTN", err)
+		}
+	})
+	if ctrlErr != nil {
+		err = ctrlErr
+	}
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+func setWinsize(f *os.File, size WindowSize) error {
+	var err error
+	ctrlErr := rawControl(f, func(fd int) {
+		err = unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, &unix.Winsize{Row: size.Rows, Col: size.Cols})
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	if err != nil {
+		return os.NewSyscallError("ioctl TIOCSWINSZ", err)
+	}
+	return nil
+}
+
+// rawControl runs fn on the descriptor of f without switching it to
+// blocking mode as Fd does, so Close still interrupts a pending Read.
+func rawControl(f *os.File, fn func(fd int)) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return conn.Control(func(fd uintptr) {
+		fn(int(fd))
+	})
+}
+
+// ptyReader reports the EIO a pty master returns once all slave ends are
+// closed as io.EOF.
+type ptyReader struct {
+	*os.File
+}
+
+func (r ptyReader) Read(p []byte) (int, error) {
+	n, err := r.File.Read(p)
+	if errors.Is(err, syscall.EIO) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// ptyInput ends the input with the terminal's EOF character on Close
+// instead of closing the terminal. It only takes effect at the start of a
+// line.
+type ptyInput struct {
+	*os.File
+}
+
+func (w ptyInput) Close() error {
+	_, err := w.File.Write([]byte{4})
+	return err
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCmdPty(t *testing.T) {
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skip(err)
+	}
+	cmd := NewCmd().SetPty(true)
+	defer cmd.Close()
+	if err := cmd.SetWindowSize(WindowSize{Rows: 40, Cols: 100}); err != nil {
+		t.Fatal(err)
+	}
+	resized := make(chan error, 1)
+	cmd.OnStdoutLine(func(line string) {
+		if line == "40 100" {
+			go func() { resized <- cmd.SetWindowSize(WindowSize{Rows: 50, Cols: 120}) }()
+		}
+	})
+	script := `test -t 0 && test -t 1 && test -t 2 && echo tty
+stty size
+while [ "$(stty size)" = "40 100" ]; do sleep 0.05; done
+stty size
+echo err >&2`
+	out, err := cmd.RunCommand("/bin/sh", "-c", script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-resized; err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(out), "tty\r\n40 100\r\n50 120\r\nerr\r\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	size, err := cmd.GetWindowSize()
+	if err != nil || size != (WindowSize{Rows: 50, Cols: 120}) {
+		t.Fatalf("GetWindowSize: %v %v", size, err)
+	}
+}
@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+)
+
+// Result describes a finished subprocess run. StdinErr is the first error
+// writing stdin, e.g. EPIPE when the subprocess exited without reading all
+// of it, and does not affect the exit status. StdoutDropped and
+// StderrDropped count the bytes a capture limit did not keep, StdoutSpill
+// and StderrSpill name the temp files they were spilled to.
+type Result struct {
+	Pid           int
+	Stdout        []byte
+	Stderr        []byte
+	StdoutDropped int64
+	StderrDropped int64
+	StdoutSpill   string
+	StderrSpill   string
+	SpillErr      error
+	ExitCode      int
+	Signal        syscall.Signal
+	Signaled      bool
+	TimedOut      bool
+	Canceled      bool
+	StopStep      StopStep
+	Limit         string
+	Cgroup        *CgroupStats
+	Usage         *ResourceUsage
+	StdinErr      error
+	StartTime     time.Time
+	EndTime       time.Time
+	Duration      time.Duration
+}
+
+// CgroupStats is the accounting read from the command's cgroup on linux.
+type CgroupStats struct {
+	Path        string
+	MemoryPeak  uint64
+	CPUUsage    time.Duration
+	CPUUser     time.Duration
+	CPUSystem   time.Duration
+	NrThrottled uint64
+	Throttled   time.Duration
+	OOM         uint64
+	OOMKills    uint64
+}
+
+// ResourceSample is the usage of the command's process tree at one point
+// in time, read from /proc on linux. ReadBytes and WriteBytes count storage
+// I/O of the processes alive at that time.
+type ResourceSample struct {
+	Time       time.Time
+	CPUPercent float64
+	RSS        uint64
+	ReadBytes  uint64
+	WriteBytes uint64
+	Threads    int
+	Processes  int
+}
+
+// ResourceUsage is what the command used on linux. The samples and their
+// summary are only set with SetSampleInterval, CPUPercent is relative to
+// one CPU, ReadBytes and WriteBytes are the highest totals sampled.
+// MaxRSS, UserTime, SysTime and the context switches are the rusage of
+// wait4 and include descendants that were waited for and the start-up of
+// the init trampoline when one is used.
+type ResourceUsage struct {
+	Samples                []ResourceSample
+	PeakCPUPercent         float64
+	AvgCPUPercent          float64
+	PeakRSS                uint64
+	AvgRSS                 uint64
+	PeakThreads            int
+	ReadBytes              uint64
+	WriteBytes             uint64
+	MaxRSS                 uint64
+	UserTime               time.Duration
+	SysTime                time.Duration
+	VoluntaryCtxSwitches   int64
+	InvoluntaryCtxSwitches int64
+}
+
+func (r *Result) Success() bool {
+	return r.ExitCode == 0 && !r.Signaled
+}
+
+func (c *Cmd) finishResult(res *Result) {
+	res.EndTime = time.Now()
+	res.Duration = res.EndTime.Sub(res.StartTime)
+	if c.cmd.ProcessState != nil && !c.cmd.ProcessState.Success() {
+		ctxErr := c.contextErr()
+		res.TimedOut = errors.Is(ctxErr, context.DeadlineExceeded)
+		res.Canceled = errors.Is(ctxErr, context.Canceled)
+	}
+
+	c.waitStdin()
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	res.StdinErr = c.stdinErr
+	if !c.exitTime.IsZero() {
+		res.EndTime = c.exitTime
+		res.Duration = res.EndTime.Sub(res.StartTime)
+	}
+	if c.stdoutbuf != nil {
+		res.Stdout = c.stdoutbuf.Bytes()
+		res.StdoutDropped = c.stdoutbuf.Dropped()
+		res.StdoutSpill, res.SpillErr = c.stdoutbuf.SpillFile()
+	}
+	if c.stderrbuf != nil {
+		res.Stderr = c.stderrbuf.Bytes()
+		res.StderrDropped = c.stderrbuf.Dropped()
+		var err error
+		if res.StderrSpill, err = c.stderrbuf.SpillFile(); res.SpillErr == nil {
+			res.SpillErr = err
+		}
+	}
+
+	state := c.cmd.ProcessState
+	if state == nil {
+		res.ExitCode = -1
+		return
+	}
+	res.ExitCode = state.ExitCode()
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		res.Signaled = true
+		res.Signal = status.Signal()
+	}
+	res.StopStep = c.stopStep
+	if res.StopStep == StopKill && res.Signal != syscall.SIGKILL {
+		// the first signal ended it right as the grace period ran out
+		res.StopStep = StopSignal
+	}
+}
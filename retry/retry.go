@@ -18,10 +18,38 @@ import (
 	"time"
 )
 
+// Backoff is the delay between retries: Delay times the number of the
+// attempt plus a random jitter below Jitter, capped at Max when it is set.
+// It is not safe for concurrent use.
+type Backoff struct {
+	Delay  time.Duration
+	Jitter time.Duration
+	Max    time.Duration
+	rnd    *rand.Rand
+}
+
+// Duration returns the delay after the failed attempt, counted from 0.
+func (b *Backoff) Duration(attempt int) time.Duration {
+	d := b.Delay * time.Duration(attempt+1)
+	if b.Jitter > 0 {
+		if b.rnd == nil {
+			b.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		d += time.Duration(b.rnd.Int63n(int64(b.Jitter)))
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
 func RetryWithBackoff(ctx context.Context, maxRetries int, retryDelaySeconds int, operation func() error) (err error) {
 
 	stime := time.Now()
-	rndEng := rand.New(rand.NewSource(stime.UnixNano()))
+	backoff := &Backoff{
+		Delay:  time.Duration(retryDelaySeconds) * time.Second,
+		Jitter: 3 * time.Second,
+	}
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		fmt.Printf("Attempt %d[%f]\n", attempt+1, time.Now().Sub(stime).Abs().Seconds())
 
@@ -38,8 +66,7 @@ func RetryWithBackoff(ctx context.Context, maxRetries int, retryDelaySeconds int
 		}
 
 		fmt.Printf("Error: %s\n", err)
-		sec := rndEng.Intn(3)
-		time.Sleep(time.Duration(retryDelaySeconds*(attempt+1)+sec) * time.Second)
+		time.Sleep(backoff.Duration(attempt))
 	}
 
 	return fmt.Errorf("Max retries reached. Last error: %s\n", err)
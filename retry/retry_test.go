@@ -39,3 +39,13 @@ func TestRetryBackoff(t *testing.T) {
 	}
 	t.Log("done")
 }
+
+func TestBackoff(t *testing.T) {
+	b := &retry.Backoff{Delay: time.Second, Jitter: time.Second, Max: 3 * time.Second}
+	for attempt, min := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		d := b.Duration(attempt)
+		if d < min || d >= min+time.Second || d > b.Max {
+			t.Fatalf("attempt %d: unexpected delay %s", attempt, d)
+		}
+	}
+}
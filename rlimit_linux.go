@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Rlimit is a resource limit applied to the subprocess before it execs,
+// resource is one of the unix.RLIMIT_* constants.
+type Rlimit struct {
+	Resource int    `json:"resource"`
+	Soft     uint64 `json:"soft"`
+	Hard     uint64 `json:"hard"`
+}
+
+const RlimInfinity = unix.RLIM_INFINITY
+
+func (c *Cmd) SetRlimit(resource int, soft, hard uint64) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i := range c.rlimits {
+		if c.rlimits[i].Resource == resource {
+			c.rlimits[i].Soft = soft
+			c.rlimits[i].Hard = hard
+			return c
+		}
+	}
+	c.rlimits = append(c.rlimits, Rlimit{Resource: resource, Soft: soft, Hard: hard})
+	return c
+}
+
+func (c *Cmd) GetRlimits() []Rlimit {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return append([]Rlimit(nil), c.rlimits...)
+}
+
+func rlimitName(resource int) string {
+	switch resource {
+	case unix.RLIMIT_AS:
+		return "RLIMIT_AS"
+	case unix.RLIMIT_CORE:
+		return "RLIMIT_CORE"
+	case unix.RLIMIT_CPU:
+		return "RLIMIT_CPU"
+	case unix.RLIMIT_DATA:
+		return "RLIMIT_DATA"
+	case unix.RLIMIT_FSIZE:
+		return "RLIMIT_FSIZE"
+	case unix.RLIMIT_NOFILE:
+		return "RLIMIT_NOFILE"
+	case unix.RLIMIT_NPROC:
+		return "RLIMIT_NPROC"
+	case unix.RLIMIT_STACK:
+		return "RLIMIT_STACK"
+	default:
+		return "RLIMIT_" + strconv.Itoa(resource)
+	}
+}
+
+// exceededLimit returns the name of the resource limit that terminated the
+// subprocess, if any. Only limits enforced with a signal can be detected:
+// SIGXCPU/SIGKILL for RLIMIT_CPU and SIGXFSZ for RLIMIT_FSIZE.
+func (c *Cmd) exceededLimit(res *Result) string {
+	if !res.Signaled {
+		return ""
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, l := range c.rlimits {
+		switch {
+		case l.Resource == unix.RLIMIT_CPU && res.Signal == syscall.SIGXCPU:
+			return rlimitName(l.Resource)
+		case l.Resource == unix.RLIMIT_CPU && res.Signal == syscall.SIGKILL && l.Hard != RlimInfinity:
+			// the kernel sends SIGKILL once the hard limit is reached
+			// rusage is tick based and lags a little behind the
+			// accounting the kernel enforces the limit with
+			limit := time.Duration(l.Hard) * time.Second * 95 / 100
+			if state := c.cmd.ProcessState; state != nil && state.UserTime()+state.SystemTime() >= limit {
+				return rlimitName(l.Resource)
+			}
+		case l.Resource == unix.RLIMIT_FSIZE && res.Signal == syscall.SIGXFSZ:
+			return rlimitName(l.Resource)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCmdRlimit(t *testing.T) {
+	cmd := NewCmd().SetRlimit(unix.RLIMIT_NOFILE, 64, 128)
+	defer cmd.Close()
+	out, err := cmd.RunCommand("/bin/sh", "-c", "ulimit -Sn; ulimit -Hn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Fields(string(out))[0] != "64" || strings.Fields(string(out))[1] != "128" {
+		t.Fatalf("unexpected limits: %q", out)
+	}
+
+	cmd = NewCmd().SetRlimit(unix.RLIMIT_CPU, 1, 3)
+	defer cmd.Close()
+	res, err := cmd.RunCommandResult("/bin/sh", "-c", "while :; do :; done")
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Resource != "RLIMIT_CPU" {
+		t.Fatalf("expected LimitError, got %#v", err)
+	}
+	var sigErr *SignaledError
+	if !errors.As(err, &sigErr) || sigErr.Signal != syscall.SIGXCPU || res.Limit != "RLIMIT_CPU" {
+		t.Fatalf("expected SIGXCPU, got %#v", err)
+	}
+
+	_, err = NewCmd().SetRlimit(unix.RLIMIT_NOFILE, 64, 64).RunCommand("/nonexistent/command")
+	var startErr *StartError
+	if !errors.As(err, &startErr) || !errors.Is(err, syscall.ENOENT) {
+		t.Fatalf("expected StartError, got %#v", err)
+	}
+}
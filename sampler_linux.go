@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SetSampleInterval samples the CPU, memory, I/O and thread usage of the
+// command and its descendants every interval while it runs, see
+// Result.Usage. Zero disables sampling.
+func (c *Cmd) SetSampleInterval(interval time.Duration) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sampleEvery = interval
+	return c
+}
+
+// resourceSampler polls /proc for the process tree of pid until stop is
+// closed.
+type resourceSampler struct {
+	lock     sync.Mutex
+	samples  []ResourceSample
+	done     chan struct{}
+	cpuTicks uint64
+	last     time.Time
+}
+
+// startSampler starts sampling the running subprocess if enabled.
+func (c *Cmd) startSampler() {
+	c.lock.Lock()
+	c.sampler = nil
+	if c.sampleEvery <= 0 || c.cmd.Process == nil || c.waitDone == nil {
+		c.lock.Unlock()
+		return
+	}
+	s := &resourceSampler{done: make(chan struct{})}
+	c.sampler = s
+	pid, interval, stop := c.cmd.Process.Pid, c.sampleEvery, c.waitDone
+	c.lock.Unlock()
+
+	// the baseline for the CPU usage of the first sample
+	s.sample(pid)
+	s.lock.Lock()
+	s.samples = nil
+	s.lock.Unlock()
+	go s.run(pid, interval, stop)
+}
+
+func (s *resourceSampler) run(pid int, interval time.Duration, stop <-chan struct{}) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.sample(pid)
+		}
+	}
+}
+
+func (s *resourceSampler) sample(pid int) {
+	now := time.Now()
+	sample := ResourceSample{Time: now}
+	var cpuTicks uint64
+	for _, p := range append([]int{pid}, descendantPids(pid)...) {
+		fields, err := readStatFields(p)
+		if err != nil || len(fields) < 22 {
+			// exited in the meantime
+			continue
+		}
+		// the times of waited for children move to cutime and cstime
+		for _, i := range []int{11, 12, 13, 14} {
+			n, _ := strconv.ParseUint(fields[i], 10, 64)
+			cpuTicks += n
+		}
+		threads, _ := strconv.Atoi(fields[17])
+		rss, _ := strconv.ParseUint(fields[21], 10, 64)
+		sample.Threads += threads
+		sample.RSS += rss * uint64(os.Getpagesize())
+		sample.Processes++
+		read, write := readIOBytes(p)
+		sample.ReadBytes += read
+		sample.WriteBytes += write
+	}
+	if sample.Processes == 0 {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.last.IsZero() && cpuTicks > s.cpuTicks {
+		cpu := ticksToDuration(cpuTicks - s.cpuTicks)
+		sample.CPUPercent = 100 * float64(cpu) / float64(now.Sub(s.last))
+	}
+	s.cpuTicks = cpuTicks
+	s.last = now
+	s.samples = append(s.samples, sample)
+}
+
+// readIOBytes returns the storage I/O of pid, zero if it is not readable.
+func readIOBytes(pid int) (read, write uint64) {
+	f, err := os.Open(procDir(pid) + "/io")
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		n, _ := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		switch key {
+		case "read_bytes":
+			read = n
+		case "write_bytes":
+			write = n
+		}
+	}
+	return read, write
+}
+
+// finishUsage sets the rusage of the exited subprocess and the samples
+// with their summary.
+func (c *Cmd) finishUsage(res *Result) {
+	c.lock.RLock()
+	s := c.sampler
+	state := c.cmd.ProcessState
+	c.lock.RUnlock()
+	if state == nil {
+		return
+	}
+	usage := &ResourceUsage{}
+	if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+		usage.MaxRSS = uint64(ru.Maxrss) * 1024
+		usage.UserTime = time.Duration(ru.Utime.Nano())
+		usage.SysTime = time.Duration(ru.Stime.Nano())
+		usage.VoluntaryCtxSwitches = int64(ru.Nvcsw)
+		usage.InvoluntaryCtxSwitches = int64(ru.Nivcsw)
+	}
+	res.Usage = usage
+	if s == nil {
+		return
+	}
+	<-s.done
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	usage.Samples = s.samples
+	if len(s.samples) == 0 {
+		return
+	}
+	var cpu float64
+	var rss uint64
+	for _, sample := range s.samples {
+		cpu += sample.CPUPercent
+		rss += sample.RSS
+		if sample.CPUPercent > usage.PeakCPUPercent {
+			usage.PeakCPUPercent = sample.CPUPercent
+		}
+		if sample.RSS > usage.PeakRSS {
+			usage.PeakRSS = sample.RSS
+		}
+		if sample.Threads > usage.PeakThreads {
+			usage.PeakThreads = sample.Threads
+		}
+		if sample.ReadBytes > usage.ReadBytes {
+			usage.ReadBytes = sample.ReadBytes
+		}
+		if sample.WriteBytes > usage.WriteBytes {
+			usage.WriteBytes = sample.WriteBytes
+		}
+	}
+	usage.AvgCPUPercent = cpu / float64(len(s.samples))
+	usage.AvgRSS = rss / uint64(len(s.samples))
+}
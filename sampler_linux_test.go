@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCmdSampleUsage(t *testing.T) {
+	cmd := NewCmd().SetSampleInterval(50 * time.Millisecond)
+	defer cmd.Close()
+	res, err := cmd.RunCommandResult("/bin/sh", "-c", "yes > /dev/null & p=$!; sleep 0.5; kill $p; wait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := res.Usage
+	if u == nil || len(u.Samples) < 3 {
+		t.Fatalf("expected samples, got %+v", u)
+	}
+	var processes int
+	for _, s := range u.Samples {
+		if s.Processes > processes {
+			processes = s.Processes
+		}
+	}
+	if processes < 2 || u.PeakCPUPercent < 10 || u.AvgCPUPercent <= 0 || u.PeakRSS == 0 || u.AvgRSS == 0 || u.PeakThreads < 2 {
+		t.Fatalf("unexpected summary: %d processes, cpu %.1f%% peak %.1f%% avg, rss %d peak %d avg, %d threads",
+			processes, u.PeakCPUPercent, u.AvgCPUPercent, u.PeakRSS, u.AvgRSS, u.PeakThreads)
+	}
+	if u.MaxRSS == 0 || u.UserTime+u.SysTime < 100*time.Millisecond || u.VoluntaryCtxSwitches == 0 {
+		t.Fatalf("unexpected rusage: maxrss %d, user %s, sys %s, %d switches",
+			u.MaxRSS, u.UserTime, u.SysTime, u.VoluntaryCtxSwitches)
+	}
+
+	// rusage only without an interval
+	cmd2 := NewCmd()
+	defer cmd2.Close()
+	res, err = cmd2.RunCommandResult("true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Usage == nil || res.Usage.Samples != nil || res.Usage.MaxRSS == 0 {
+		t.Fatalf("unexpected usage %+v", res.Usage)
+	}
+}
@@ -0,0 +1,264 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SeccompAction is what the kernel does when a filter rule matches.
+type SeccompAction uint32
+
+const (
+	SeccompKill  SeccompAction = 0x80000000 // SECCOMP_RET_KILL_PROCESS
+	SeccompTrap  SeccompAction = 0x00030000 // SECCOMP_RET_TRAP
+	SeccompLog   SeccompAction = 0x7ffc0000 // SECCOMP_RET_LOG
+	SeccompAllow SeccompAction = 0x7fff0000 // SECCOMP_RET_ALLOW
+
+	seccompRetErrno = 0x00050000
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArgs = 16
+)
+
+// SeccompErrno makes the syscall fail with errno instead of running it.
+func SeccompErrno(errno syscall.Errno) SeccompAction {
+	return SeccompAction(seccompRetErrno | uint32(errno)&0xffff)
+}
+
+// Built-in seccomp profiles, see SeccompProfile.
+const (
+	SeccompNoNetwork            = "no-network"
+	SeccompNoPtrace             = "no-ptrace"
+	SeccompDefaultDenyDangerous = "default-deny-dangerous"
+)
+
+// SeccompArg restricts a rule to calls whose argument Index, masked with
+// Mask (all bits when zero), equals Value.
+type SeccompArg struct {
+	Index int
+	Value uint64
+	Mask  uint64
+}
+
+type seccompRule struct {
+	syscall string
+	action  SeccompAction
+	args    []SeccompArg
+}
+
+// SeccompFilter is a syscall filter built by name. Rules are checked in the
+// order they were added, calls no rule matches get the default action. Use
+// SeccompAllow as default with denying rules for a denylist, or a denying
+// default with SeccompAllow rules for an allowlist. The filter is installed
+// right before the command is exec'd, so it has to allow execve.
+type SeccompFilter struct {
+	defaultAction SeccompAction
+	rules         []seccompRule
+	optional      bool
+}
+
+func NewSeccompFilter(defaultAction SeccompAction) *SeccompFilter {
+	return &SeccompFilter{defaultAction: defaultAction}
+}
+
+// Add applies action to every call of the named syscalls.
+func (f *SeccompFilter) Add(action SeccompAction, syscalls ...string) *SeccompFilter {
+	for _, name := range syscalls {
+		f.rules = append(f.rules, seccompRule{syscall: name, action: action})
+	}
+	return f
+}
+
+// AddArgs applies action to calls of syscall whose arguments match all args.
+func (f *SeccompFilter) AddArgs(action SeccompAction, syscall string, args ...SeccompArg) *SeccompFilter {
+	f.rules = append(f.rules, seccompRule{syscall: syscall, action: action, args: args})
+	return f
+}
+
+// SeccompProfile returns one of the built-in filters. Syscalls that do not
+// exist on the current architecture are skipped.
+func SeccompProfile(name string) (*SeccompFilter, error) {
+	eperm := SeccompErrno(syscall.EPERM)
+	f := NewSeccompFilter(SeccompAllow)
+	f.optional = true
+	switch name {
+	case SeccompNoNetwork:
+		for _, family := range []uint64{unix.AF_INET, unix.AF_INET6, unix.AF_PACKET} {
+			f.AddArgs(SeccompErrno(syscall.EACCES), "socket", SeccompArg{Index: 0, Value: family})
+		}
+	case SeccompNoPtrace:
+		f.Add(eperm, "ptrace", "process_vm_readv", "process_vm_writev")
+	case SeccompDefaultDenyDangerous:
+		f.Add(eperm,
+			"ptrace", "process_vm_readv", "process_vm_writev",
+			"mount", "umount2", "pivot_root", "chroot",
+			"kexec_load", "kexec_file_load", "reboot",
+			"init_module", "finit_module", "delete_module",
+			"swapon", "swapoff", "acct", "quotactl",
+			"bpf", "perf_event_open", "userfaultfd",
+			"add_key", "request_key", "keyctl",
+			"settimeofday", "clock_settime", "adjtimex", "clock_adjtime",
+			"iopl", "ioperm", "open_by_handle_at", "lookup_dcookie")
+		f.AddArgs(eperm, "socket", SeccompArg{Index: 1, Value: unix.SOCK_RAW, Mask: 0xf})
+	default:
+		return nil, fmt.Errorf("unknown seccomp profile %q", name)
+	}
+	return f, nil
+}
+
+// Compile turns the filter into a BPF program for the current architecture.
+func (f *SeccompFilter) Compile() ([]unix.SockFilter, error) {
+	if seccompAuditArch == 0 {
+		return nil, errors.New("seccomp filters are not supported on " + runtime.GOARCH)
+	}
+	prog := []unix.SockFilter{
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArch),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, seccompAuditArch, 1, 0),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, uint32(SeccompKill)),
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr),
+	}
+	if seccompX32Bit != 0 {
+		prog = append(prog,
+			bpfJump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, seccompX32Bit, 0, 1),
+			bpfStmt(unix.BPF_RET|unix.BPF_K, uint32(SeccompKill)))
+	}
+
+	for _, rule := range f.rules {
+		nr, ok := seccompSyscalls[rule.syscall]
+		if !ok {
+			if f.optional {
+				continue
+			}
+			return nil, fmt.Errorf("unknown syscall %q on %s", rule.syscall, runtime.GOARCH)
+		}
+		block, err := rule.compile(nr)
+		if err != nil {
+			return nil, err
+		}
+		prog = append(prog, block...)
+	}
+	prog = append(prog, bpfStmt(unix.BPF_RET|unix.BPF_K, uint32(f.defaultAction)))
+	if len(prog) > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("seccomp filter too long: %d instructions", len(prog))
+	}
+	return prog, nil
+}
+
+// compile emits the checks for one rule. The accumulator holds the syscall
+// number on entry and on every exit that falls through to the next rule.
+func (r seccompRule) compile(nr uint32) ([]unix.SockFilter, error) {
+	if len(r.args) == 0 {
+		return []unix.SockFilter{
+			bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, nr, 0, 1),
+			bpfStmt(unix.BPF_RET|unix.BPF_K, uint32(r.action)),
+		}, nil
+	}
+
+	// jumps to the trailing reload of the syscall number are patched at the end
+	var block []unix.SockFilter
+	var fails []int
+	block = append(block, bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, nr, 0, 0))
+	fails = append(fails, 0)
+	for _, arg := range r.args {
+		if arg.Index < 0 || arg.Index > 5 {
+			return nil, fmt.Errorf("%s: invalid argument index %d", r.syscall, arg.Index)
+		}
+		mask := arg.Mask
+		if mask == 0 {
+			mask = ^uint64(0)
+		}
+		// arguments are 64 bit little endian, compare both halves
+		for _, half := range []struct {
+			off   uint32
+			mask  uint32
+			value uint32
+		}{
+			{seccompDataArgs + 8*uint32(arg.Index) + 4, uint32(mask >> 32), uint32(arg.Value >> 32)},
+			{seccompDataArgs + 8*uint32(arg.Index), uint32(mask), uint32(arg.Value)},
+		} {
+			block = append(block, bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, half.off))
+			if half.mask != 0xffffffff {
+				block = append(block, bpfStmt(unix.BPF_ALU|unix.BPF_AND|unix.BPF_K, half.mask))
+			}
+			block = append(block, bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, half.value&half.mask, 0, 0))
+			fails = append(fails, len(block)-1)
+		}
+	}
+	block = append(block, bpfStmt(unix.BPF_RET|unix.BPF_K, uint32(r.action)))
+	block = append(block, bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr))
+	reload := len(block) - 1
+	for _, i := range fails {
+		off := reload - i - 1
+		if off > 255 {
+			return nil, fmt.Errorf("%s: too many argument checks", r.syscall)
+		}
+		block[i].Jf = uint8(off)
+	}
+	return block, nil
+}
+
+func bpfStmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// SetSeccomp installs the filters in the subprocess right before exec,
+// together with no_new_privs. Several filters stack, the strictest action
+// wins.
+func (c *Cmd) SetSeccomp(filters ...*SeccompFilter) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seccomp = append(c.seccomp, filters...)
+	return c
+}
+
+// SetSeccompProfile is SetSeccomp with built-in profiles by name.
+func (c *Cmd) SetSeccompProfile(names ...string) error {
+	for _, name := range names {
+		f, err := SeccompProfile(name)
+		if err != nil {
+			return err
+		}
+		c.SetSeccomp(f)
+	}
+	return nil
+}
+
+// compileSeccomp compiles the configured filters. The caller holds c.lock.
+func (c *Cmd) compileSeccomp() ([][]unix.SockFilter, error) {
+	var progs [][]unix.SockFilter
+	for _, f := range c.seccomp {
+		prog, err := f.Compile()
+		if err != nil {
+			return nil, err
+		}
+		progs = append(progs, prog)
+	}
+	return progs, nil
+}
+
+// installSeccomp runs in the trampoline as the last step before exec.
+func installSeccomp(progs [][]unix.SockFilter) error {
+	if len(progs) == 0 {
+		return nil
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return os.NewSyscallError("prctl(PR_SET_NO_NEW_PRIVS)", err)
+	}
+	for _, prog := range progs {
+		fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+		if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&fprog)), 0, 0); err != nil {
+			return os.NewSyscallError("prctl(PR_SET_SECCOMP)", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestCmdSeccomp(t *testing.T) {
+	if seccompAuditArch == 0 {
+		t.Skip("seccomp not supported on this architecture")
+	}
+	dir := t.TempDir()
+	filter := NewSeccompFilter(SeccompAllow).Add(SeccompErrno(syscall.EPERM), "mkdir", "mkdirat")
+	cmd := NewCmd().SetSeccomp(filter)
+	defer cmd.Close()
+	res, err := cmd.RunCommandResult("/bin/sh", "-c", "mkdir "+filepath.Join(dir, "blocked"))
+	if err == nil {
+		t.Fatal("mkdir succeeded under seccomp")
+	}
+	if !strings.Contains(strings.ToLower(string(res.Stderr)), syscall.EPERM.Error()) {
+		t.Fatalf("expected EPERM, got %q", res.Stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "blocked")); !os.IsNotExist(err) {
+		t.Fatalf("directory was created: %v", err)
+	}
+
+	cmd2 := NewCmd()
+	if err := cmd2.SetSeccompProfile(SeccompDefaultDenyDangerous, SeccompNoNetwork); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd2.Close()
+	out, err := cmd2.RunCommand("/bin/sh", "-c", "mkdir "+filepath.Join(dir, "allowed")+" && echo ok")
+	if err != nil || strings.TrimSpace(string(out)) != "ok" {
+		t.Fatalf("profile blocked an allowed syscall: %v %q", err, out)
+	}
+
+	cmd3 := NewCmd().SetSeccomp(NewSeccompFilter(SeccompAllow).Add(SeccompKill, "no_such_syscall"))
+	defer cmd3.Close()
+	if _, err := cmd3.Command("/bin/true"); err == nil {
+		t.Fatal("expected an error for an unknown syscall")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build linux && !amd64 && !arm64
+
+package utils
+
+// seccomp filters are only built for amd64 and arm64
+const (
+	seccompAuditArch = 0
+	seccompX32Bit    = 0
+)
+
+var seccompSyscalls = map[string]uint32{}
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SetStdin feeds r to the stdin of the subprocess in the background and
+// closes stdin once r is exhausted, e.g. a bytes.Reader or an *os.File.
+// Write errors end up in Result.StdinErr. A read from r that blocks after
+// the subprocess exited, e.g. from os.Stdin, does not hold the Result up.
+func (c *Cmd) SetStdin(r io.Reader) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stdinSource = r
+	return c
+}
+
+// WriteInput writes p to the stdin of the running subprocess.
+func (c *Cmd) WriteInput(p []byte) (int, error) {
+	c.lock.RLock()
+	stdin := c.stdin
+	c.lock.RUnlock()
+	if stdin == nil {
+		return 0, ErrSubprocessExited
+	}
+	n, err := stdin.Write(p)
+	if err != nil {
+		c.setStdinErr(err)
+	}
+	return n, err
+}
+
+// CloseInput closes the stdin of the running subprocess, so it reads EOF.
+func (c *Cmd) CloseInput() error {
+	c.lock.RLock()
+	stdin := c.stdin
+	c.lock.RUnlock()
+	if stdin == nil {
+		return ErrSubprocessExited
+	}
+	err := stdin.Close()
+	if errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// stdinPipe connects a pipe to the stdin of the command. Unlike
+// exec.Cmd.StdinPipe the write end is not closed by Wait, so a pending
+// write fails with EPIPE once the subprocess exits. The caller closes the
+// returned read end after the command was started and holds c.lock.
+func (c *Cmd) stdinPipe() (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	c.cmd.Stdin = r
+	c.stdin = w
+	return r, nil
+}
+
+// closeStdinPipe closes the parent end of the stdin pipe of a command that
+// could not be started. The caller holds c.lock.
+func (c *Cmd) closeStdinPipe() {
+	if c.stdin != nil {
+		c.stdin.Close()
+		c.stdin = nil
+	}
+}
+
+// waitStdin waits for the stdin copy to finish. A grandchild may keep the
+// pipe open or the source may block in Read, which closing the pipe does
+// not interrupt, so after readerStopDelay the pipe is closed and the copy
+// left to end on its own.
+func (c *Cmd) waitStdin() {
+	c.lock.RLock()
+	done := c.stdinDone
+	stdin := c.stdin
+	c.lock.RUnlock()
+	if done == nil {
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(readerStopDelay):
+		stdin.Close()
+	}
+}
+
+// startStdin starts copying the stdin source, if any, into the subprocess.
+// The caller holds c.lock.
+func (c *Cmd) startStdin() {
+	c.stdinErr = nil
+	c.stdinDone = nil
+	if c.stdinSource == nil || c.stdin == nil {
+		return
+	}
+	done := make(chan struct{})
+	c.stdinDone = done
+	go c.copyStdin(c.stdinSource, c.stdin, done)
+}
+
+func (c *Cmd) copyStdin(src io.Reader, stdin io.WriteCloser, done chan struct{}) {
+	defer close(done)
+	_, err := io.Copy(stdin, src)
+	if cerr := stdin.Close(); err == nil && !errors.Is(cerr, os.ErrClosed) {
+		err = cerr
+	}
+	if err != nil {
+		if c.debug {
+			log.Error(err)
+		}
+		c.lock.Lock()
+		// a copy left behind by waitStdin does not report into a later run
+		if c.stdinDone == done && c.stdinErr == nil {
+			c.stdinErr = err
+		}
+		c.lock.Unlock()
+	}
+}
+
+// setStdinErr keeps the first stdin write error for the Result.
+func (c *Cmd) setStdinErr(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stdinErr == nil {
+		c.stdinErr = err
+	}
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCmdStdin(t *testing.T) {
+	cmd := NewCmd().SetStdin(strings.NewReader("hello\nworld\n"))
+	defer cmd.Close()
+	res, err := cmd.RunCommandResult("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Stdout) != "hello\nworld\n" || res.StdinErr != nil {
+		t.Fatalf("unexpected result %q %v", res.Stdout, res.StdinErr)
+	}
+
+	// the subprocess exits without reading all input
+	cmd2 := NewCmd().SetStdin(bytes.NewReader(make([]byte, 1<<20)))
+	defer cmd2.Close()
+	res, err = cmd2.RunCommandResult("/bin/sh", "-c", "head -c 10 > /dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Success() || !errors.Is(res.StdinErr, syscall.EPIPE) {
+		t.Fatalf("expected EPIPE with a successful exit, got %d %v", res.ExitCode, res.StdinErr)
+	}
+
+	cmd3 := NewCmd()
+	defer cmd3.Close()
+	if _, err := cmd3.Command("cat"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd3.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"abc", "def\n"} {
+		if _, err := cmd3.WriteInput([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cmd3.CloseInput(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := cmd3.Run()
+	if err != nil || string(out) != "abcdef\n" {
+		t.Fatalf("unexpected output %q %v", out, err)
+	}
+
+	// a source that blocks does not hold the Result up
+	r, w := io.Pipe()
+	defer w.Close()
+	cmd4 := NewCmd().SetStdin(r)
+	defer cmd4.Close()
+	start := time.Now()
+	if _, err := cmd4.RunCommandResult("true"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > readerStopDelay+time.Second {
+		t.Fatalf("waited %v for the stdin copy", d)
+	}
+}
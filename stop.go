@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const DefaultStopGrace = 5 * time.Second
+
+// StopPolicy controls how a subprocess is terminated on timeout,
+// cancellation, Close or Stop: Signal is sent first and, if the process is
+// still alive after Grace, it is killed with SIGKILL.
+// The zero value sends SIGTERM and waits DefaultStopGrace.
+type StopPolicy struct {
+	Signal os.Signal
+	Grace  time.Duration
+}
+
+func (p StopPolicy) withDefaults() StopPolicy {
+	if p.Signal == nil {
+		p.Signal = syscall.SIGTERM
+	}
+	if p.Grace <= 0 {
+		p.Grace = DefaultStopGrace
+	}
+	return p
+}
+
+// StopStep records which step of the stop policy ended the subprocess.
+type StopStep int
+
+const (
+	StopNone StopStep = iota
+	StopSignal
+	StopKill
+)
+
+func (s StopStep) String() string {
+	switch s {
+	case StopSignal:
+		return "signal"
+	case StopKill:
+		return "kill"
+	default:
+		return "none"
+	}
+}
+
+func (c *Cmd) SetStopPolicy(policy StopPolicy) *Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stopPolicy = policy
+	return c
+}
+
+// Stop terminates the subprocess with the stop policy and waits until it
+// has exited. If ctx is done before the grace period is over, SIGKILL is
+// sent right away.
+func (c *Cmd) Stop(ctx context.Context) error {
+	c.lock.Lock()
+	done := c.waitDone
+	if done == nil {
+		c.lock.Unlock()
+		return ErrSubprocessExited
+	}
+	if c.ctxErr == nil {
+		c.ctxErr = context.Canceled
+	}
+	c.lock.Unlock()
+
+	c.terminate(ctx, done)
+	go c.drain(done)
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Cmd) terminate(ctx context.Context, done <-chan struct{}) {
+	c.lock.Lock()
+	if c.stopStep != StopNone || c.cmd.Process == nil {
+		c.lock.Unlock()
+		return
+	}
+	policy := c.stopPolicy.withDefaults()
+	proc := c.cmd.Process
+	c.stopStep = StopSignal
+	if policy.Signal == syscall.SIGKILL {
+		c.stopStep = StopKill
+	}
+	debug := c.debug
+	c.lock.Unlock()
+
+	if debug {
+		log.Infof("stopping pid %d with %s", proc.Pid, policy.Signal.String())
+	}
+	if err := c.signal(proc, policy.Signal); err != nil {
+		return
+	}
+	if policy.Signal == syscall.SIGKILL {
+		return
+	}
+	c.continueStopped(proc)
+
+	timer := time.NewTimer(policy.Grace)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	c.lock.Lock()
+	c.stopStep = StopKill
+	c.lock.Unlock()
+	if debug {
+		log.Infof("pid %d still running, sending SIGKILL", proc.Pid)
+	}
+	c.signalTree(proc, syscall.SIGKILL, false)
+}
+
+func (c *Cmd) signal(proc *os.Process, sig os.Signal) error {
+	if s, ok := sig.(syscall.Signal); ok {
+		return c.signalTree(proc, s, false)
+	}
+	return proc.Signal(sig)
+}
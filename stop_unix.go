@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// continueStopped lets a subprocess stopped with Pause or held by Command
+// handle the stop signal, it only does once it is continued. One held at
+// exec gets it before the command runs, one held in the init trampoline
+// exits on it without running.
+func (c *Cmd) continueStopped(proc *os.Process) {
+	c.releaseTrace()
+	c.signal(proc, syscall.SIGCONT)
+}
@@ -0,0 +1,9 @@
+package utils
+
+import (
+	"os"
+)
+
+// continueStopped does nothing, windows processes are not stopped by
+// signals.
+func (c *Cmd) continueStopped(proc *os.Process) {}
@@ -0,0 +1,377 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/realjf/utils/retry"
+	log "github.com/sirupsen/logrus"
+)
+
+// RestartPolicy decides whether a Supervisor restarts its command after it
+// exited.
+type RestartPolicy int
+
+const (
+	RestartAlways RestartPolicy = iota
+	RestartOnFailure
+	RestartNever
+)
+
+func (p RestartPolicy) String() string {
+	switch p {
+	case RestartAlways:
+		return "always"
+	case RestartOnFailure:
+		return "on-failure"
+	case RestartNever:
+		return "never"
+	default:
+		return "unknown"
+	}
+}
+
+func (p RestartPolicy) restart(err error) bool {
+	switch p {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return err != nil
+	default:
+		return false
+	}
+}
+
+// SupervisorEventType is the lifecycle step a SupervisorEvent reports.
+type SupervisorEventType int
+
+const (
+	SupervisorStarted SupervisorEventType = iota
+	SupervisorExited
+	SupervisorRestarting
+	SupervisorGaveUp
+)
+
+func (t SupervisorEventType) String() string {
+	switch t {
+	case SupervisorStarted:
+		return "started"
+	case SupervisorExited:
+		return "exited"
+	case SupervisorRestarting:
+		return "restarting"
+	case SupervisorGaveUp:
+		return "given-up"
+	default:
+		return "unknown"
+	}
+}
+
+// SupervisorEvent is passed to the OnEvent handler. Restarts is the number
+// of restarts so far. Exited events carry the Result, which is nil when the
+// command could not be started, and the error of the run, Restarting events
+// the Delay before the next start and GaveUp events a GaveUpError.
+type SupervisorEvent struct {
+	Type     SupervisorEventType
+	Time     time.Time
+	Pid      int
+	Restarts int
+	Result   *Result
+	Err      error
+	Delay    time.Duration
+}
+
+// Supervisor runs a command and restarts it according to its restart
+// policy, waiting for the backoff between restarts. Every run gets a new
+// Cmd from newCmd, so the Cmd setters, e.g. the stop policy, apply to all
+// of them.
+type Supervisor struct {
+	name        string
+	args        []string
+	newCmd      func() *Cmd
+	policy      RestartPolicy
+	maxRestarts int
+	window      time.Duration
+	backoff     *retry.Backoff
+	onEvent     func(SupervisorEvent)
+	debug       bool
+	lock        sync.Mutex
+	cmd         *Cmd
+	stopping    bool
+	stop        chan struct{}
+	done        chan struct{}
+	err         error
+}
+
+// NewSupervisor supervises the command name with args. newCmd configures
+// the Cmd of each run, nil uses NewCmd.
+func NewSupervisor(newCmd func() *Cmd, name string, args ...string) *Supervisor {
+	if newCmd == nil {
+		newCmd = NewCmd
+	}
+	return &Supervisor{
+		name:   name,
+		args:   args,
+		newCmd: newCmd,
+		policy: RestartAlways,
+		backoff: &retry.Backoff{
+			Delay:  time.Second,
+			Jitter: time.Second,
+			Max:    time.Minute,
+		},
+	}
+}
+
+func (s *Supervisor) SetRestartPolicy(policy RestartPolicy) *Supervisor {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.policy = policy
+	return s
+}
+
+// SetMaxRestarts gives up once the command was restarted max times within
+// window. A window of 0 counts all restarts, a max of 0 never gives up.
+func (s *Supervisor) SetMaxRestarts(max int, window time.Duration) *Supervisor {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.maxRestarts = max
+	s.window = window
+	return s
+}
+
+// SetBackoff sets the delay before a restart. The attempt passed to it is
+// the number of restarts within the window of SetMaxRestarts.
+func (s *Supervisor) SetBackoff(backoff *retry.Backoff) *Supervisor {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.backoff = backoff
+	return s
+}
+
+// OnEvent sets the handler of the lifecycle events. It is called from the
+// supervisor goroutine, a slow handler delays the restarts.
+func (s *Supervisor) OnEvent(handler func(SupervisorEvent)) *Supervisor {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.onEvent = handler
+	return s
+}
+
+func (s *Supervisor) SetDebug(debug bool) *Supervisor {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.debug = debug
+	return s
+}
+
+// Start runs the command in the background until Stop, until ctx is done
+// or until it is not restarted anymore. When ctx is done the running
+// command is stopped with its stop policy.
+func (s *Supervisor) Start(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.done != nil {
+		return errors.New("supervisor already started")
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run(ctx)
+	return nil
+}
+
+// Run starts the supervisor and waits until it is done.
+func (s *Supervisor) Run(ctx context.Context) error {
+	if err := s.Start(ctx); err != nil {
+		return err
+	}
+	return s.Wait()
+}
+
+// Wait blocks until the supervisor is done. It returns nil after Stop or
+// when the command is not restarted after a successful run, the error of
+// the last run when it is not restarted after a failure, a GaveUpError
+// after too many restarts and the error of ctx when it is done.
+func (s *Supervisor) Wait() error {
+	s.lock.Lock()
+	done := s.done
+	s.lock.Unlock()
+	if done == nil {
+		return errors.New("supervisor not started")
+	}
+	<-done
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// Stop ends the supervisor: the running command is stopped with its stop
+// policy and not restarted. If ctx is done before the grace period is over,
+// SIGKILL is sent right away.
+func (s *Supervisor) Stop(ctx context.Context) error {
+	s.lock.Lock()
+	if s.done == nil {
+		s.lock.Unlock()
+		return nil
+	}
+	if !s.stopping {
+		s.stopping = true
+		close(s.stop)
+	}
+	cmd := s.cmd
+	done := s.done
+	s.lock.Unlock()
+
+	if cmd != nil {
+		if err := cmd.Stop(ctx); err != nil && !errors.Is(err, ErrSubprocessExited) {
+			return err
+		}
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Supervisor) run(ctx context.Context) {
+	s.lock.Lock()
+	policy := s.policy
+	maxRestarts := s.maxRestarts
+	window := s.window
+	backoff := s.backoff
+	s.lock.Unlock()
+
+	var err error
+	defer func() {
+		s.lock.Lock()
+		s.err = err
+		s.lock.Unlock()
+		close(s.done)
+	}()
+
+	// the restarts within the window, only kept when there is one
+	var recent []time.Time
+	for restarts := 0; ; restarts++ {
+		err = s.runOnce(ctx, restarts)
+		if s.stopped() {
+			err = nil
+			return
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
+		if !policy.restart(err) {
+			return
+		}
+
+		attempt := restarts
+		if window > 0 {
+			recent = dropBefore(recent, time.Now().Add(-window))
+			attempt = len(recent)
+		}
+		if maxRestarts > 0 && attempt >= maxRestarts {
+			err = &GaveUpError{Restarts: attempt, Window: window, Err: err}
+			s.emit(SupervisorEvent{Type: SupervisorGaveUp, Restarts: restarts, Err: err})
+			return
+		}
+		delay := backoff.Duration(attempt)
+		s.emit(SupervisorEvent{Type: SupervisorRestarting, Restarts: restarts, Err: err, Delay: delay})
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			err = ctx.Err()
+			return
+		case <-s.stop:
+			timer.Stop()
+			err = nil
+			return
+		}
+		if window > 0 {
+			recent = append(recent, time.Now())
+		}
+	}
+}
+
+// runOnce starts the command with a new Cmd and waits until it exited.
+func (s *Supervisor) runOnce(ctx context.Context, restarts int) error {
+	cmd := s.newCmd()
+	defer cmd.Close()
+	if s.stopped() {
+		return nil
+	}
+	pid, err := cmd.CommandContext(ctx, s.name, s.args...)
+	if err != nil {
+		if s.isDebug() {
+			log.Errorf("supervisor: %s", err.Error())
+		}
+		s.emit(SupervisorEvent{Type: SupervisorExited, Restarts: restarts, Err: err})
+		return err
+	}
+
+	s.lock.Lock()
+	stopping := s.stopping
+	if !stopping {
+		s.cmd = cmd
+	}
+	s.lock.Unlock()
+	if stopping {
+		// still held, the stop signal is delivered before it runs, a
+		// command that ignores it is killed after the grace period
+		if err := cmd.Stop(ctx); err != nil && !errors.Is(err, ErrSubprocessExited) {
+			if s.isDebug() {
+				log.Errorf("supervisor: stop pid %d: %s", pid, err.Error())
+			}
+			return err
+		}
+		return nil
+	}
+
+	s.emit(SupervisorEvent{Type: SupervisorStarted, Pid: pid, Restarts: restarts})
+	res, err := cmd.RunResultContext(ctx)
+	s.lock.Lock()
+	s.cmd = nil
+	s.lock.Unlock()
+	if s.isDebug() {
+		log.Infof("supervisor: pid %d exited: %v", pid, err)
+	}
+	s.emit(SupervisorEvent{Type: SupervisorExited, Pid: pid, Restarts: restarts, Result: res, Err: err})
+	return err
+}
+
+func (s *Supervisor) emit(event SupervisorEvent) {
+	s.lock.Lock()
+	handler := s.onEvent
+	s.lock.Unlock()
+	if handler == nil {
+		return
+	}
+	event.Time = time.Now()
+	handler(event)
+}
+
+func (s *Supervisor) stopped() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stopping
+}
+
+func (s *Supervisor) isDebug() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.debug
+}
+
+// dropBefore removes the times before t from the sorted times.
+func dropBefore(times []time.Time, t time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(t) {
+		i++
+	}
+	return times[i:]
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/realjf/utils/retry"
+)
+
+type eventLog struct {
+	lock   sync.Mutex
+	events []SupervisorEvent
+}
+
+func (l *eventLog) add(event SupervisorEvent) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *eventLog) types() []SupervisorEventType {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	types := make([]SupervisorEventType, len(l.events))
+	for i, event := range l.events {
+		types[i] = event.Type
+	}
+	return types
+}
+
+func (l *eventLog) count(t SupervisorEventType) int {
+	n := 0
+	for _, got := range l.types() {
+		if got == t {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSupervisorGiveUp(t *testing.T) {
+	events := &eventLog{}
+	s := NewSupervisor(nil, "/bin/sh", "-c", "exit 4").
+		SetRestartPolicy(RestartOnFailure).
+		SetMaxRestarts(2, time.Minute).
+		SetBackoff(&retry.Backoff{Delay: 10 * time.Millisecond}).
+		OnEvent(events.add)
+	err := s.Run(context.Background())
+	var gaveUp *GaveUpError
+	var exitErr *ExitError
+	if !errors.As(err, &gaveUp) || gaveUp.Restarts != 2 || !errors.As(err, &exitErr) || exitErr.Code != 4 {
+		t.Fatalf("expected to give up, got %v", err)
+	}
+	want := []SupervisorEventType{
+		SupervisorStarted, SupervisorExited, SupervisorRestarting,
+		SupervisorStarted, SupervisorExited, SupervisorRestarting,
+		SupervisorStarted, SupervisorExited, SupervisorGaveUp,
+	}
+	got := events.types()
+	if len(got) != len(want) {
+		t.Fatalf("unexpected events %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("unexpected events %v", got)
+		}
+	}
+	if events.events[4].Result == nil || events.events[4].Result.ExitCode != 4 || events.events[5].Delay != 20*time.Millisecond {
+		t.Fatalf("unexpected event %+v", events.events[4])
+	}
+
+	// not restarted after a success or with RestartNever
+	events = &eventLog{}
+	if err := NewSupervisor(nil, "true").SetRestartPolicy(RestartOnFailure).OnEvent(events.add).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	err = NewSupervisor(nil, "false").SetRestartPolicy(RestartNever).OnEvent(events.add).Run(context.Background())
+	if !errors.As(err, &exitErr) || events.count(SupervisorStarted) != 2 {
+		t.Fatalf("expected one run each, got %v %v", err, events.types())
+	}
+}
+
+func TestSupervisorStop(t *testing.T) {
+	events := &eventLog{}
+	started := make(chan struct{}, 10)
+	var lock sync.Mutex
+	var out []string
+	newCmd := func() *Cmd {
+		return NewCmd().SetStopPolicy(StopPolicy{Grace: 2 * time.Second}).OnStdoutLine(func(line string) {
+			lock.Lock()
+			out = append(out, line)
+			lock.Unlock()
+		})
+	}
+	s := NewSupervisor(newCmd, "/bin/sh", "-c", "trap 'echo bye; exit 0' TERM; echo up; sleep 5 > /dev/null 2>&1 & wait").
+		SetBackoff(&retry.Backoff{Delay: 10 * time.Millisecond}).
+		OnEvent(func(event SupervisorEvent) {
+			events.add(event)
+			if event.Type == SupervisorStarted {
+				started <- struct{}{}
+			}
+		})
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err == nil {
+		t.Fatal("started twice")
+	}
+	<-started
+	// let the shell install its trap
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		n := len(out)
+		lock.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(out) != 2 || out[1] != "bye" {
+		t.Fatalf("not stopped gracefully: %q", out)
+	}
+	if got := events.types(); len(got) != 2 || got[1] != SupervisorExited || events.events[1].Result.StopStep != StopSignal {
+		t.Fatalf("unexpected events %v", got)
+	}
+
+	// canceling the context stops it as well
+	ctx, cancel = context.WithCancel(context.Background())
+	s = NewSupervisor(nil, "sleep", "5").OnEvent(func(event SupervisorEvent) {
+		if event.Type == SupervisorStarted {
+			cancel()
+		}
+	})
+	if err := s.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
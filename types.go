@@ -1,7 +1,6 @@
 package utils
 
 import (
-	"bufio"
 	"bytes"
 	"io"
 	"sync"
@@ -13,34 +12,121 @@ const (
 	STDERR int = 2
 )
 
+const (
+	readChunkSize = 32 * 1024
+	// DefaultMaxLineLength is where LineSplitter cuts lines that never end.
+	DefaultMaxLineLength = 1024 * 1024
+)
+
+// IOReadCloser captures everything read from a pipe, or as much as its
+// limit allows. It reads raw chunks and writes them to itself as the sink,
+// so binary output and a last line without a newline end up in Bytes
+// unchanged.
 type IOReadCloser struct {
-	io     io.ReadCloser
-	lock   sync.RWMutex
-	reader *bufio.Reader
-	buf    bytes.Buffer
+	io       io.ReadCloser
+	lock     sync.RWMutex
+	readLock sync.Mutex
+	buf      captureBuffer
+	chunk    []byte
+	pending  []byte
+	observe  []func([]byte)
 }
 
 func NewReader(io io.ReadCloser) *IOReadCloser {
 	return &IOReadCloser{
-		io:     io,
-		lock:   sync.RWMutex{},
-		reader: bufio.NewReader(io),
-		buf:    bytes.Buffer{},
+		io:    io,
+		lock:  sync.RWMutex{},
+		chunk: make([]byte, readChunkSize),
 	}
 }
 
-func (io *IOReadCloser) Read() (string, error) {
+// SetLimit bounds how much of the output is kept. It has to be called
+// before reading starts.
+func (io *IOReadCloser) SetLimit(limit CaptureLimit) {
 	io.lock.Lock()
 	defer io.lock.Unlock()
-	str, err := io.reader.ReadString('\n')
-	if err != nil {
-		return "", err
+	io.buf = captureBuffer{limit: limit}
+}
+
+// Dropped returns how many bytes were not kept because of the limit.
+func (io *IOReadCloser) Dropped() int64 {
+	io.lock.RLock()
+	defer io.lock.RUnlock()
+	return io.buf.dropped
+}
+
+// SpillFile returns the temp file the dropped bytes were written to, if
+// any, and the error that stopped writing it.
+func (io *IOReadCloser) SpillFile() (string, error) {
+	io.lock.RLock()
+	defer io.lock.RUnlock()
+	return io.buf.spilled, io.buf.spillErr
+}
+
+// addObserver registers fn for every chunk read. It has to be called
+// before reading starts.
+func (io *IOReadCloser) addObserver(fn func([]byte)) {
+	io.observe = append(io.observe, fn)
+}
+
+// Write appends p to the captured output.
+func (io *IOReadCloser) Write(p []byte) (int, error) {
+	io.lock.Lock()
+	defer io.lock.Unlock()
+	return io.buf.Write(p)
+}
+
+// ReadChunk reads the next chunk from the pipe and captures it. The
+// returned slice is only valid until the next call. Data is returned
+// together with the error that ended the read, e.g. io.EOF.
+func (io *IOReadCloser) ReadChunk() ([]byte, error) {
+	io.readLock.Lock()
+	defer io.readLock.Unlock()
+	return io.readChunk()
+}
+
+// readChunk does not hold io.lock while it blocks in Read, so Bytes can be
+// called meanwhile. The caller holds io.readLock.
+func (io *IOReadCloser) readChunk() ([]byte, error) {
+	n, err := io.io.Read(io.chunk)
+	chunk := io.chunk[:n]
+	if n > 0 {
+		io.Write(chunk)
+		for _, fn := range io.observe {
+			fn(chunk)
+		}
 	}
-	_, err = io.buf.WriteString(str)
 	if err != nil {
-		return "", err
+		io.lock.Lock()
+		io.buf.closeSpill()
+		io.lock.Unlock()
+	}
+	return chunk, err
+}
+
+// Read returns the next line including its newline. A last line without a
+// newline is returned as is, the error that ended the output follows on the
+// next call.
+func (io *IOReadCloser) Read() (string, error) {
+	io.readLock.Lock()
+	defer io.readLock.Unlock()
+	for {
+		if i := bytes.IndexByte(io.pending, '\n'); i >= 0 {
+			line := string(io.pending[:i+1])
+			io.pending = io.pending[i+1:]
+			return line, nil
+		}
+		chunk, err := io.readChunk()
+		io.pending = append(io.pending, chunk...)
+		if err != nil {
+			if len(io.pending) > 0 {
+				line := string(io.pending)
+				io.pending = nil
+				return line, nil
+			}
+			return "", err
+		}
 	}
-	return str, nil
 }
 
 func (io *IOReadCloser) Bytes() []byte {
@@ -48,3 +134,57 @@ func (io *IOReadCloser) Bytes() []byte {
 	defer io.lock.RUnlock()
 	return io.buf.Bytes()
 }
+
+// LineSplitter is a writer that cuts what is written to it into lines and
+// passes each one, newline included, to a callback. Lines longer than
+// MaxLength are passed on in pieces of MaxLength bytes.
+type LineSplitter struct {
+	MaxLength int
+	fn        func(line []byte)
+	buf       []byte
+}
+
+func NewLineSplitter(fn func(line []byte)) *LineSplitter {
+	return &LineSplitter{MaxLength: DefaultMaxLineLength, fn: fn}
+}
+
+func (s *LineSplitter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			s.buf = append(s.buf, p...)
+			break
+		}
+		if len(s.buf) == 0 {
+			// a complete line, no need to copy it
+			s.emit(p[:i+1])
+		} else {
+			s.buf = append(s.buf, p[:i+1]...)
+			s.emit(s.buf)
+			s.buf = s.buf[:0]
+		}
+		p = p[i+1:]
+	}
+	for s.MaxLength > 0 && len(s.buf) >= s.MaxLength {
+		s.fn(s.buf[:s.MaxLength])
+		s.buf = append(s.buf[:0], s.buf[s.MaxLength:]...)
+	}
+	return n, nil
+}
+
+func (s *LineSplitter) emit(line []byte) {
+	for s.MaxLength > 0 && len(line) > s.MaxLength {
+		s.fn(line[:s.MaxLength])
+		line = line[s.MaxLength:]
+	}
+	s.fn(line)
+}
+
+// Flush passes on a last line that has no newline.
+func (s *LineSplitter) Flush() {
+	if len(s.buf) > 0 {
+		s.fn(s.buf)
+		s.buf = s.buf[:0]
+	}
+}
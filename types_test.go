@@ -0,0 +1,82 @@
+package utils_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/realjf/utils"
+)
+
+func TestIOReadCloserBinary(t *testing.T) {
+	data := make([]byte, 256*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	r := utils.NewReader(io.NopCloser(bytes.NewReader(data)))
+	for {
+		_, err := r.ReadChunk()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(r.Bytes(), data) {
+		t.Fatal("captured output differs from the input")
+	}
+}
+
+func TestIOReadCloserLines(t *testing.T) {
+	r := utils.NewReader(io.NopCloser(strings.NewReader("one\ntwo\nno newline")))
+	var lines []string
+	for {
+		line, err := r.Read()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.Fatal(err)
+			}
+			break
+		}
+		lines = append(lines, line)
+	}
+	if strings.Join(lines, "|") != "one\n|two\n|no newline" {
+		t.Fatalf("unexpected lines %q", lines)
+	}
+	if string(r.Bytes()) != "one\ntwo\nno newline" {
+		t.Fatalf("unexpected capture %q", r.Bytes())
+	}
+}
+
+func TestLineSplitter(t *testing.T) {
+	long := strings.Repeat("x", 3*utils.DefaultMaxLineLength+10)
+	input := "a\r\nb" + "c\n" + long + "\n" + "tail"
+	var lines []string
+	s := utils.NewLineSplitter(func(line []byte) {
+		lines = append(lines, string(line))
+	})
+	// write in odd pieces so lines span several writes
+	for i := 0; i < len(input); i += 4093 {
+		end := i + 4093
+		if end > len(input) {
+			end = len(input)
+		}
+		s.Write([]byte(input[i:end]))
+	}
+	s.Flush()
+
+	if strings.Join(lines, "") != input {
+		t.Fatal("lines do not add up to the input")
+	}
+	if len(lines) != 7 || lines[0] != "a\r\n" || lines[1] != "bc\n" || lines[6] != "tail" {
+		t.Fatalf("unexpected split into %d lines", len(lines))
+	}
+	for _, line := range lines {
+		if len(line) > utils.DefaultMaxLineLength {
+			t.Fatalf("line of %d bytes exceeds the maximum", len(line))
+		}
+	}
+}
@@ -1,20 +1,16 @@
 package utils
 
 import (
+	"os/exec"
 	"strconv"
-
-	log "github.com/sirupsen/logrus"
+	"strings"
 )
 
+// CheckProcStateIsStopped reports whether pid is stopped by a signal.
 func CheckProcStateIsStopped(pid int) (bool, error) {
-	args := []string{"-aeo", "ppid,pid,user,stat,pcpu,comm,wchan:32", "|", strconv.Itoa(pid), "|", "T"}
-	out, err := NewCmd().RunCommand("ps", args...)
+	out, err := exec.Command("ps", "-o", "stat=", "-p", strconv.Itoa(pid)).Output()
 	if err != nil {
 		return false, err
 	}
-	log.Infof("%s", out)
-	if string(out) != "" {
-		return true, nil
-	}
-	return false, nil
+	return strings.HasPrefix(strings.TrimSpace(string(out)), "T"), nil
 }
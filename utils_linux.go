@@ -1,20 +1,12 @@
 package utils
 
-import (
-	"strconv"
-
-	log "github.com/sirupsen/logrus"
-)
-
+// CheckProcStateIsStopped reports whether pid is stopped by a signal or
+// traced, read from /proc.
 func CheckProcStateIsStopped(pid int) (bool, error) {
-	args := []string{"-aeo", "ppid,pid,user,stat,pcpu,comm,wchan:32", "|", strconv.Itoa(pid), "|", "T"}
-	out, err := NewCmd().RunCommand("ps", args...)
+	fields, err := readStatFields(pid)
 	if err != nil {
 		return false, err
 	}
-	log.Infof("%s", out)
-	if string(out) != "" {
-		return true, nil
-	}
-	return false, nil
+	state := ProcessState(fields[0][0])
+	return state == ProcessStopped || state == ProcessTracingStop, nil
 }